@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// Login authenticates as a registered account, Register creates one. Both
+// wait for the server's answer and must be called after Dial but before
+// Start, on success the account name becomes the chat name.
+func (c *TcpChatClient) Login(name, password string) error {
+	return c.authenticate(protocol.AuthCommand{Name: name, Password: password})
+}
+
+func (c *TcpChatClient) Register(name, password string) error {
+	if err := protocol.ValidName(name); err != nil {
+		return err
+	}
+	if err := protocol.ValidPassword(password); err != nil {
+		return err
+	}
+	return c.authenticate(protocol.RegisterCommand{Name: name, Password: password})
+}
+
+func (c *TcpChatClient) authenticate(cmd protocol.Command) error {
+	if !c.Supports(protocol.FeatureAuth) {
+		return errors.New("server does not support accounts")
+	}
+	return c.await(cmd, func(reply protocol.Command) bool {
+		_, ok := reply.(protocol.AuthedCommand)
+		return ok
+	})
+}
+
+// await sends cmd and reads until done accepts a reply or the server answers
+// with ERROR, it is used before Start only.
+func (c *TcpChatClient) await(cmd protocol.Command, done func(reply protocol.Command) bool) error {
+	if err := c.cmdWriter.Write(cmd); err != nil {
+		return err
+	}
+	for {
+		c.setReadDeadline()
+		reply, err := c.cmdReader.Read()
+		if err != nil {
+			return fmt.Errorf("login: %v", err)
+		}
+		if done(reply) {
+			return nil
+		}
+		// Anything broadcast to the lobby before the answer is dropped,
+		// the user has not entered the chat yet.
+		switch v := reply.(type) {
+		case protocol.ErrorCommand:
+			return v
+		case protocol.PingCommand:
+			c.cmdWriter.Write(protocol.PongCommand{Token: v.Token})
+		case protocol.PongCommand:
+			c.pong(v)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/LeadNess/net-tools/chat/protocol"
 )
@@ -13,36 +17,205 @@ type ChatClient interface {
 	Dial(address string) error
 	SendMessage(message string) error
 	SetName(name string) error
+	Nick(name string) error
+	Login(name, password string) error
+	Register(name, password string) error
+	Whisper(to, message string) error
+	Join(room string) error
+	Part(room string) error
+	ListRooms() error
+	SendFile(to, path string) (string, error)
+	AcceptFile(id string) error
+	Edit(id uint64, message string) error
+	Delete(id uint64) error
+	SetStatus(status, text string) error
+	Search(query protocol.SearchCommand) error
 	Start()
 	Close()
+	Features() []string
 	Incoming() chan protocol.MessageCommand
-	ChatUsers() chan []string
+	History() chan protocol.HistoryCommand
+	Acks() chan protocol.AckCommand
+	Whispers() chan protocol.PrivateMessageCommand
+	Errors() chan protocol.ErrorCommand
+	Joined() chan string
+	Rooms() chan []protocol.RoomInfo
+	FileOffers() chan protocol.FileOfferCommand
+	Downloads() chan Download
+	Edits() chan protocol.EditCommand
+	Deletes() chan protocol.DeleteCommand
+	Results() chan protocol.ResultsCommand
+	Renames() chan protocol.RenameCommand
+	ChatUsers() chan []protocol.UserInfo
 }
 
 type TcpChatClient struct {
+	latency   int64
 	conn      net.Conn
 	cmdReader *protocol.CommandReader
 	cmdWriter *protocol.CommandWriter
-	name      string
+	version   int
+	features  []string
+	codec     protocol.Codec
 	incoming  chan protocol.MessageCommand
-	users     chan []string
+	history   chan protocol.HistoryCommand
+	acks      chan protocol.AckCommand
+	whispers  chan protocol.PrivateMessageCommand
+	errors    chan protocol.ErrorCommand
+	joined    chan string
+	rooms     chan []protocol.RoomInfo
+	users     chan []protocol.UserInfo
+	edits     chan protocol.EditCommand
+	deletes   chan protocol.DeleteCommand
+	results   chan protocol.ResultsCommand
+	renames   chan protocol.RenameCommand
+	done      chan struct{}
+
+	pingInterval     time.Duration
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+	knownHosts       string
+
+	downloadDir   string
+	fileOffers    chan protocol.FileOfferCommand
+	downloads     chan Download
+	offers        map[string]protocol.FileOfferCommand
+	outgoing      map[string]string
+	incomingFiles map[string]*incomingFile
+	filesMutex    *sync.Mutex
 }
 
 func NewClient() *TcpChatClient {
 	return &TcpChatClient{
+		codec:    protocol.TextCodec,
+		done:     make(chan struct{}),
 		incoming: make(chan protocol.MessageCommand),
-		users: make(chan []string),
+		history:  make(chan protocol.HistoryCommand),
+		acks:     make(chan protocol.AckCommand),
+		whispers: make(chan protocol.PrivateMessageCommand),
+		errors:   make(chan protocol.ErrorCommand),
+		joined:   make(chan string),
+		rooms:    make(chan []protocol.RoomInfo),
+		users:    make(chan []protocol.UserInfo),
+		edits:    make(chan protocol.EditCommand),
+		deletes:  make(chan protocol.DeleteCommand),
+		results:  make(chan protocol.ResultsCommand),
+		renames:  make(chan protocol.RenameCommand),
+
+		pingInterval:     DefaultPingInterval,
+		idleTimeout:      DefaultIdleTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		knownHosts:       DefaultKnownHostsFile,
+
+		downloadDir:   DefaultDownloadDir,
+		fileOffers:    make(chan protocol.FileOfferCommand),
+		downloads:     make(chan Download),
+		offers:        make(map[string]protocol.FileOfferCommand),
+		outgoing:      make(map[string]string),
+		incomingFiles: make(map[string]*incomingFile),
+		filesMutex:    &sync.Mutex{},
 	}
 }
 
+// TLSScheme and UnixScheme prefix addresses that Dial reaches over TLS and
+// unix domain sockets.
+const (
+	TLSScheme  = "tls://"
+	UnixScheme = "unix://"
+)
+
+// Dial connects to address, a "tls://" prefix switches to TLS with the
+// server certificate pinned in the known hosts file and "unix://" connects
+// to a unix domain socket.
 func (c *TcpChatClient) Dial(address string) error {
-	conn, err := net.Dial("tcp", address)
-	if err == nil {
-		c.conn = conn
+	var conn net.Conn
+	var err error
+	switch {
+	case strings.HasPrefix(address, TLSScheme):
+		conn, err = c.dialTLS(strings.TrimPrefix(address, TLSScheme))
+	case strings.HasPrefix(address, UnixScheme):
+		conn, err = net.Dial("unix", strings.TrimPrefix(address, UnixScheme))
+	default:
+		conn, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
 	}
+	c.conn = conn
 	c.cmdReader = protocol.NewCommandReader(conn)
 	c.cmdWriter = protocol.NewCommandWriter(conn)
-	return err
+	c.cmdReader.SetCodec(c.codec)
+	c.cmdWriter.SetCodec(c.codec)
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return err
+	}
+	if c.Supports(protocol.FeaturePing) {
+		go c.heartbeat()
+	}
+	return nil
+}
+
+// SetCodec selects the wire encoding used by the next Dial, the server
+// detects it from the first bytes of the connection.
+func (c *TcpChatClient) SetCodec(codec protocol.Codec) {
+	c.codec = codec
+}
+
+// DefaultHandshakeTimeout is how long Dial waits for the answer to HELLO,
+// servers predating it never answer.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// SetHandshakeTimeout sets how long Dial waits for the server to answer
+// HELLO, zero waits forever.
+func (c *TcpChatClient) SetHandshakeTimeout(timeout time.Duration) {
+	c.handshakeTimeout = timeout
+}
+
+func (c *TcpChatClient) handshake() error {
+	if c.handshakeTimeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.handshakeTimeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	err := c.cmdWriter.Write(protocol.HelloCommand{
+		Version:  protocol.Version,
+		Features: protocol.Features,
+	})
+	if err != nil {
+		return err
+	}
+	cmd, err := c.cmdReader.Read()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("handshake: no answer from the server within %v", c.handshakeTimeout)
+	} else if err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	switch v := cmd.(type) {
+	case protocol.WelcomeCommand:
+		c.version = v.Version
+		c.features = v.Features
+		c.cmdWriter.SetVersion(v.Version)
+		return nil
+	case protocol.RejectCommand:
+		return fmt.Errorf("rejected by server: %v", v.Reason)
+	}
+	return errors.New("unexpected handshake reply")
+}
+
+func (c *TcpChatClient) Close() {
+	c.conn.Close()
+}
+
+func (c *TcpChatClient) Version() int {
+	return c.version
+}
+
+func (c *TcpChatClient) Features() []string {
+	return c.features
+}
+
+func (c *TcpChatClient) Supports(feature string) bool {
+	return protocol.HasFeature(c.features, feature)
 }
 
 func (c *TcpChatClient) SendMessage(message string) error {
@@ -52,34 +225,159 @@ func (c *TcpChatClient) SendMessage(message string) error {
 }
 
 func (c *TcpChatClient) SetName(name string) error {
+	if err := protocol.ValidName(name); err != nil {
+		return err
+	}
 	return c.cmdWriter.Write(protocol.NameCommand{Name: name})
 }
 
-func (c * TcpChatClient) Incoming() chan protocol.MessageCommand  {
+func (c *TcpChatClient) Whisper(to, message string) error {
+	return c.cmdWriter.Write(protocol.WhisperCommand{
+		To:      to,
+		Message: message,
+	})
+}
+
+func (c *TcpChatClient) Join(room string) error {
+	return c.cmdWriter.Write(protocol.JoinCommand{Room: room})
+}
+
+func (c *TcpChatClient) Part(room string) error {
+	return c.cmdWriter.Write(protocol.PartCommand{Room: room})
+}
+
+func (c *TcpChatClient) ListRooms() error {
+	return c.cmdWriter.Write(protocol.ListCommand{})
+}
+
+func (c *TcpChatClient) Edit(id uint64, message string) error {
+	return c.cmdWriter.Write(protocol.EditCommand{
+		ID:      id,
+		Message: message,
+	})
+}
+
+func (c *TcpChatClient) Delete(id uint64) error {
+	return c.cmdWriter.Write(protocol.DeleteCommand{ID: id})
+}
+
+func (c *TcpChatClient) SetStatus(status, text string) error {
+	if err := protocol.ValidStatus(status, text); err != nil {
+		return err
+	}
+	return c.cmdWriter.Write(protocol.StatusCommand{
+		Status: status,
+		Text:   text,
+	})
+}
+
+// Search asks the server for past messages, the answer arrives on
+// Results().
+func (c *TcpChatClient) Search(query protocol.SearchCommand) error {
+	if err := protocol.ValidSearch(query); err != nil {
+		return err
+	}
+	return c.cmdWriter.Write(query)
+}
+
+func (c *TcpChatClient) Incoming() chan protocol.MessageCommand {
 	return c.incoming
 }
 
-func (c * TcpChatClient) ChatUsers() chan []string  {
+// History delivers the backlog of the room replayed once the client has a
+// name.
+func (c *TcpChatClient) History() chan protocol.HistoryCommand {
+	return c.history
+}
+
+func (c *TcpChatClient) Acks() chan protocol.AckCommand {
+	return c.acks
+}
+
+func (c *TcpChatClient) Whispers() chan protocol.PrivateMessageCommand {
+	return c.whispers
+}
+
+func (c *TcpChatClient) Errors() chan protocol.ErrorCommand {
+	return c.errors
+}
+
+func (c *TcpChatClient) Edits() chan protocol.EditCommand {
+	return c.edits
+}
+
+func (c *TcpChatClient) Deletes() chan protocol.DeleteCommand {
+	return c.deletes
+}
+
+func (c *TcpChatClient) Results() chan protocol.ResultsCommand {
+	return c.results
+}
+
+func (c *TcpChatClient) Joined() chan string {
+	return c.joined
+}
+
+func (c *TcpChatClient) Rooms() chan []protocol.RoomInfo {
+	return c.rooms
+}
+
+func (c *TcpChatClient) ChatUsers() chan []protocol.UserInfo {
 	return c.users
 }
 
 func (c *TcpChatClient) Start() {
+	defer close(c.done)
 	for {
+		c.setReadDeadline()
 		cmd, err := c.cmdReader.Read()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			log.Printf("Read error %v", err)
+			if _, recoverable := protocol.ErrorFor(err); !recoverable {
+				break
+			}
 		}
 		if cmd != nil {
 			switch v := cmd.(type) {
 			case protocol.MessageCommand:
 				c.incoming <- v
+			case protocol.HistoryCommand:
+				c.history <- v
+			case protocol.AckCommand:
+				c.acks <- v
+			case protocol.PrivateMessageCommand:
+				c.whispers <- v
+			case protocol.ErrorCommand:
+				c.errors <- v
+			case protocol.JoinCommand:
+				c.joined <- v.Room
+			case protocol.RoomsCommand:
+				c.rooms <- v.Rooms
+			case protocol.PingCommand:
+				c.cmdWriter.Write(protocol.PongCommand{Token: v.Token})
+			case protocol.PongCommand:
+				c.pong(v)
+			case protocol.FileOfferCommand:
+				c.offered(v)
+			case protocol.FileAcceptCommand:
+				go c.sendChunks(v)
+			case protocol.FileChunkCommand:
+				c.receiveChunk(v)
+			case protocol.EditCommand:
+				c.edits <- v
+			case protocol.DeleteCommand:
+				c.deletes <- v
 			case protocol.UsersCommand:
-				c.users <- strings.Split(v.Users, " ")
+				c.users <- v.Users
+			case protocol.ResultsCommand:
+				c.results <- v
+			case protocol.RenameCommand:
+				c.renames <- v
 			default:
 				log.Printf("Unknown command: %v", v)
 			}
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestHandshakeTimeout dials a server that reads HELLO and never answers,
+// like the ones predating the handshake.
+func TestHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	c := NewClient()
+	c.SetHandshakeTimeout(100 * time.Millisecond)
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- c.Dial(l.Addr().String())
+	}()
+	select {
+	case err := <-dialed:
+		if err == nil {
+			t.Fatal("Dial succeeded without an answer to HELLO")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial still waiting for the handshake")
+	}
+}
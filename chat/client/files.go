@@ -0,0 +1,215 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const DefaultDownloadDir = "downloads"
+
+// Download reports a finished (or failed) incoming file transfer.
+type Download struct {
+	ID   string
+	From string
+	Name string
+	Path string
+	Err  error
+}
+
+type incomingFile struct {
+	offer protocol.FileOfferCommand
+	file  *os.File
+	path  string
+	// received is the end of the data received so far without gaps.
+	received int64
+}
+
+func (c *TcpChatClient) SetDownloadDir(dir string) {
+	c.downloadDir = dir
+}
+
+func (c *TcpChatClient) FileOffers() chan protocol.FileOfferCommand {
+	return c.fileOffers
+}
+
+func (c *TcpChatClient) Downloads() chan Download {
+	return c.downloads
+}
+
+// SendFile offers the file to a user or to a #room, the file is streamed to
+// everybody who accepts it until the connection is closed.
+func (c *TcpChatClient) SendFile(to, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a regular file", path)
+	}
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	c.filesMutex.Lock()
+	c.outgoing[id] = path
+	c.filesMutex.Unlock()
+	return id, c.cmdWriter.Write(protocol.FileOfferCommand{
+		ID:   id,
+		To:   to,
+		Size: info.Size(),
+		Name: filepath.Base(path),
+	})
+}
+
+func (c *TcpChatClient) AcceptFile(id string) error {
+	c.filesMutex.Lock()
+	offer, ok := c.offers[id]
+	c.filesMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no such file offer: %v", id)
+	}
+	if err := os.MkdirAll(c.downloadDir, 0755); err != nil {
+		return err
+	}
+	file, path, err := createUnique(c.downloadDir, filepath.Base(offer.Name))
+	if err != nil {
+		return err
+	}
+	incoming := &incomingFile{
+		offer: offer,
+		file:  file,
+		path:  path,
+	}
+	c.filesMutex.Lock()
+	delete(c.offers, id)
+	c.incomingFiles[id] = incoming
+	c.filesMutex.Unlock()
+	if err := c.cmdWriter.Write(protocol.FileAcceptCommand{ID: id}); err != nil {
+		return err
+	}
+	if offer.Size == 0 {
+		go c.finishDownload(incoming, nil)
+	}
+	return nil
+}
+
+func (c *TcpChatClient) offered(offer protocol.FileOfferCommand) {
+	c.filesMutex.Lock()
+	c.offers[offer.ID] = offer
+	c.filesMutex.Unlock()
+	c.fileOffers <- offer
+}
+
+func (c *TcpChatClient) sendChunks(accept protocol.FileAcceptCommand) {
+	c.filesMutex.Lock()
+	path, ok := c.outgoing[accept.ID]
+	c.filesMutex.Unlock()
+	if !ok {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	buf := make([]byte, protocol.FileChunkSize)
+	var offset int64
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			chunk := protocol.FileChunkCommand{
+				ID:     accept.ID,
+				To:     accept.From,
+				Offset: offset,
+				Data:   buf[:n],
+			}
+			if err := c.cmdWriter.Write(chunk); err != nil {
+				return
+			}
+			offset += int64(n)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *TcpChatClient) receiveChunk(chunk protocol.FileChunkCommand) {
+	c.filesMutex.Lock()
+	incoming, ok := c.incomingFiles[chunk.ID]
+	c.filesMutex.Unlock()
+	if !ok {
+		return
+	}
+	if chunk.Offset > incoming.offer.Size || int64(len(chunk.Data)) > incoming.offer.Size-chunk.Offset {
+		c.finishDownload(incoming, errors.New("received more data than offered"))
+		return
+	}
+	// Chunks are sent and relayed in order, one starting past the data
+	// received so far means some got lost. Repeated data is written again
+	// but not counted twice.
+	if chunk.Offset > incoming.received {
+		c.finishDownload(incoming, fmt.Errorf("missing file data at offset %d", incoming.received))
+		return
+	}
+	if _, err := incoming.file.WriteAt(chunk.Data, chunk.Offset); err != nil {
+		c.finishDownload(incoming, err)
+		return
+	}
+	if end := chunk.Offset + int64(len(chunk.Data)); end > incoming.received {
+		incoming.received = end
+	}
+	if incoming.received >= incoming.offer.Size {
+		c.finishDownload(incoming, nil)
+	}
+}
+
+func (c *TcpChatClient) finishDownload(incoming *incomingFile, err error) {
+	c.filesMutex.Lock()
+	delete(c.incomingFiles, incoming.offer.ID)
+	c.filesMutex.Unlock()
+	if closeErr := incoming.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(incoming.path)
+	}
+	c.downloads <- Download{
+		ID:   incoming.offer.ID,
+		From: incoming.offer.From,
+		Name: incoming.offer.Name,
+		Path: incoming.path,
+		Err:  err,
+	}
+}
+
+func createUnique(dir, name string) (*os.File, string, error) {
+	if name == "." || name == string(filepath.Separator) {
+		name = "download"
+	}
+	ext := filepath.Ext(name)
+	base := name[:len(name)-len(ext)]
+	path := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return file, path, err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+func randomID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
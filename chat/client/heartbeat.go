@@ -0,0 +1,65 @@
+package client
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const (
+	DefaultPingInterval = 15 * time.Second
+	DefaultIdleTimeout  = 90 * time.Second
+)
+
+// SetHeartbeat configures how often the client pings the server and how long
+// it waits for any data before giving up on the connection.
+func (c *TcpChatClient) SetHeartbeat(interval, timeout time.Duration) {
+	c.pingInterval = interval
+	c.idleTimeout = timeout
+}
+
+// Latency returns the round-trip time measured by the last PING.
+func (c *TcpChatClient) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.latency))
+}
+
+func (c *TcpChatClient) heartbeat() {
+	if c.pingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	c.ping(time.Now())
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if err := c.ping(now); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *TcpChatClient) ping(now time.Time) error {
+	return c.cmdWriter.Write(protocol.PingCommand{
+		Token: strconv.FormatInt(now.UnixNano(), 10),
+	})
+}
+
+func (c *TcpChatClient) pong(pong protocol.PongCommand) {
+	sent, err := strconv.ParseInt(pong.Token, 10, 64)
+	if err != nil {
+		return
+	}
+	atomic.StoreInt64(&c.latency, int64(time.Since(time.Unix(0, sent))))
+}
+
+func (c *TcpChatClient) setReadDeadline() {
+	if c.idleTimeout > 0 && c.Supports(protocol.FeaturePing) {
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// Nick chooses the first chat name and waits for the server to accept it,
+// so a taken name is reported right away. Like Login it must be called after
+// Dial but before Start, SetName changes the name later on.
+func (c *TcpChatClient) Nick(name string) error {
+	if err := protocol.ValidName(name); err != nil {
+		return err
+	}
+	if !c.Supports(protocol.FeatureNick) {
+		// Older servers do not confirm names.
+		return c.SetName(name)
+	}
+	return c.await(protocol.NameCommand{Name: name}, func(reply protocol.Command) bool {
+		rename, ok := reply.(protocol.RenameCommand)
+		return ok && rename.From == "" && rename.To == name
+	})
+}
+
+// Renames delivers the name changes in the current room, including the
+// client's own.
+func (c *TcpChatClient) Renames() chan protocol.RenameCommand {
+	return c.renames
+}
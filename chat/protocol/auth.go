@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	MinPasswordLength = 6
+	MaxPasswordLength = 128
+)
+
+// AUTH logs in to a registered account and REGISTER creates one, both take
+// the name of the account. The server answers with AUTHED or ERROR.
+type AuthCommand struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type RegisterCommand struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type AuthedCommand struct {
+	Name string `json:"name"`
+}
+
+func init() {
+	Register(AuthCommand{})
+	Register(RegisterCommand{})
+	Register(AuthedCommand{})
+}
+
+func (AuthCommand) CommandName() string {
+	return "AUTH"
+}
+
+func (c AuthCommand) Encode() []string {
+	return []string{c.Name, c.Password}
+}
+
+func (AuthCommand) Decode(fields []string) (Command, error) {
+	return AuthCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func (RegisterCommand) CommandName() string {
+	return "REGISTER"
+}
+
+func (c RegisterCommand) Encode() []string {
+	return []string{c.Name, c.Password}
+}
+
+func (RegisterCommand) Decode(fields []string) (Command, error) {
+	return RegisterCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func (AuthedCommand) CommandName() string {
+	return "AUTHED"
+}
+
+func (c AuthedCommand) Encode() []string {
+	return []string{c.Name}
+}
+
+func (AuthedCommand) Decode(fields []string) (Command, error) {
+	return AuthedCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func ValidPassword(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < MinPasswordLength || length > MaxPasswordLength {
+		return fmt.Errorf("password must be %d to %d characters long", MinPasswordLength, MaxPasswordLength)
+	}
+	return nil
+}
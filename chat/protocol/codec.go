@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Codec interface {
+	Name() string
+	Encode(writer io.Writer, command Command) error
+	Decode(reader *bufio.Reader, maxSize int) (Command, error)
+}
+
+var (
+	TextCodec   Codec = textCodec{}
+	BinaryCodec Codec = binaryCodec{}
+	JSONCodec   Codec = jsonCodec{}
+)
+
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range []Codec{TextCodec, BinaryCodec, JSONCodec} {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec: %v", name)
+}
+
+// Binary frames start with the high byte of the frame length, which is always
+// zero because frames are limited by MaxFrameSize, JSON lines start with an
+// object and everything else is treated as the text protocol.
+func detectCodec(reader *bufio.Reader) (Codec, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 0:
+		return BinaryCodec, nil
+	case '{':
+		return JSONCodec, nil
+	}
+	return TextCodec, nil
+}
+
+type textCodec struct{}
+
+func (textCodec) Name() string {
+	return "text"
+}
+
+func (textCodec) Encode(writer io.Writer, command Command) error {
+	line := fmt.Sprintf("%v %v\n", command.CommandName(), encodeText(command.Encode()))
+	_, err := io.WriteString(writer, line)
+	return err
+}
+
+func (textCodec) Decode(reader *bufio.Reader, maxSize int) (Command, error) {
+	buf, err := readLine(reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	line := string(buf)
+	bufslice := strings.SplitN(line, " ", 2)
+	commandName := bufslice[0]
+	if len(bufslice) == 1 {
+		return decode(commandName, nil, line)
+	}
+	fields, err := decodeText(bufslice[1], textArity(commandName))
+	if err != nil {
+		return nil, BadCommand{
+			Name: commandName,
+			Line: line,
+			Err:  err,
+		}
+	}
+	return decode(commandName, fields, line)
+}
+
+// readLine reads a line of at most maxSize bytes without the trailing "\n" or
+// "\r\n". Longer lines are not buffered, the caller should drop the connection.
+func readLine(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxSize+1 {
+			return nil, ErrFrameTooLarge
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
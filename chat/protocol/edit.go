@@ -0,0 +1,54 @@
+package protocol
+
+// EDIT and DELETE are sent by the author of a message and broadcast by the
+// server to the room once accepted.
+type EditCommand struct {
+	ID      uint64 `json:"id"`
+	Message string `json:"message"`
+}
+
+type DeleteCommand struct {
+	ID uint64 `json:"id"`
+}
+
+func init() {
+	Register(EditCommand{})
+	Register(DeleteCommand{})
+}
+
+func (EditCommand) CommandName() string {
+	return "EDIT"
+}
+
+func (c EditCommand) Encode() []string {
+	return []string{formatID(c.ID), c.Message}
+}
+
+func (EditCommand) Decode(fields []string) (Command, error) {
+	id, err := parseID(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	return EditCommand{
+		id,
+		field(fields, 1),
+	}, nil
+}
+
+func (DeleteCommand) CommandName() string {
+	return "DELETE"
+}
+
+func (c DeleteCommand) Encode() []string {
+	return []string{formatID(c.ID)}
+}
+
+func (DeleteCommand) Decode(fields []string) (Command, error) {
+	id, err := parseID(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	return DeleteCommand{
+		id,
+	}, nil
+}
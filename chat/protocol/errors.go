@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// Error codes carried by ERROR, clients should switch on them rather than on
+// the human readable message.
+const (
+	CodeUnknownCommand = "UNKNOWN_COMMAND"
+	CodeBadCommand     = "BAD_COMMAND"
+	CodeNameTaken      = "NAME_TAKEN"
+	CodeInvalidName    = "INVALID_NAME"
+	CodeAuthFailed     = "AUTH_FAILED"
+	CodeNoSuchUser     = "NO_SUCH_USER"
+	CodeBadRequest     = "BAD_REQUEST"
+	CodeNotPermitted   = "NOT_PERMITTED"
+	CodeRateLimited    = "RATE_LIMITED"
+	CodeShuttingDown   = "SHUTTING_DOWN"
+	CodeInternal       = "INTERNAL"
+)
+
+type ErrorCommand struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func init() {
+	Register(ErrorCommand{})
+}
+
+func (ErrorCommand) CommandName() string {
+	return "ERROR"
+}
+
+func (c ErrorCommand) Encode() []string {
+	return []string{c.Code, c.Message}
+}
+
+func (ErrorCommand) Decode(fields []string) (Command, error) {
+	return ErrorCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func (c ErrorCommand) Error() string {
+	return fmt.Sprintf("%v: %v", c.Code, c.Message)
+}
+
+// BadCommand is returned by CommandReader.Read for a known command whose
+// fields could not be decoded, the stream is still usable afterwards.
+type BadCommand struct {
+	Name string
+	Line string
+	Err  error
+}
+
+func (e BadCommand) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("bad command: %v", e.Err)
+	}
+	return fmt.Sprintf("bad %v command: %v", e.Name, e.Err)
+}
+
+// ErrorFor converts an error returned by CommandReader.Read into an ERROR
+// reply. The second result reports whether the connection can keep reading.
+func ErrorFor(err error) (ErrorCommand, bool) {
+	switch v := err.(type) {
+	case UnknownCommand:
+		return ErrorCommand{Code: CodeUnknownCommand, Message: v.Error()}, true
+	case BadCommand:
+		return ErrorCommand{Code: CodeBadCommand, Message: v.Error()}, true
+	}
+	switch err {
+	case ErrBadFrame, ErrFrameTooLarge:
+		return ErrorCommand{Code: CodeBadCommand, Message: err.Error()}, false
+	}
+	return ErrorCommand{Code: CodeInternal, Message: err.Error()}, false
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+)
+
+// File transfer goes through the server: the sender offers a file to a user
+// or a #room, every recipient that accepts it gets the chunks relayed.
+type FileOfferCommand struct {
+	ID   string `json:"id"`
+	To   string `json:"to"`
+	From string `json:"from"`
+	Size int64  `json:"size"`
+	Name string `json:"name"`
+}
+
+type FileAcceptCommand struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+}
+
+type FileChunkCommand struct {
+	ID     string `json:"id"`
+	To     string `json:"to"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+const FileChunkSize = 32 * 1024
+
+func init() {
+	Register(FileOfferCommand{})
+	Register(FileAcceptCommand{})
+	Register(FileChunkCommand{})
+}
+
+func (FileOfferCommand) CommandName() string {
+	return "OFFER"
+}
+
+func (c FileOfferCommand) Encode() []string {
+	return []string{c.ID, c.To, c.From, strconv.FormatInt(c.Size, 10), c.Name}
+}
+
+func (FileOfferCommand) Decode(fields []string) (Command, error) {
+	size, err := strconv.ParseInt(field(fields, 3), 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.New("bad file size")
+	}
+	return FileOfferCommand{
+		field(fields, 0),
+		field(fields, 1),
+		field(fields, 2),
+		size,
+		field(fields, 4),
+	}, nil
+}
+
+func (FileAcceptCommand) CommandName() string {
+	return "ACCEPT"
+}
+
+func (c FileAcceptCommand) Encode() []string {
+	return []string{c.ID, c.From}
+}
+
+func (FileAcceptCommand) Decode(fields []string) (Command, error) {
+	return FileAcceptCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func (FileChunkCommand) CommandName() string {
+	return "CHUNK"
+}
+
+func (c FileChunkCommand) Encode() []string {
+	return []string{c.ID, c.To, strconv.FormatInt(c.Offset, 10), base64.StdEncoding.EncodeToString(c.Data)}
+}
+
+func (FileChunkCommand) Decode(fields []string) (Command, error) {
+	offset, err := strconv.ParseInt(field(fields, 2), 10, 64)
+	if err != nil || offset < 0 {
+		return nil, errors.New("bad chunk offset")
+	}
+	data, err := base64.StdEncoding.DecodeString(field(fields, 3))
+	if err != nil {
+		return nil, errors.New("bad chunk data")
+	}
+	return FileChunkCommand{
+		field(fields, 0),
+		field(fields, 1),
+		offset,
+		data,
+	}, nil
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Binary frame layout, all integers are big endian:
+//
+//	uint32 frame length (everything after this field)
+//	uint8  command name length, command name
+//	uint32 field length, field bytes (repeated for every field)
+//
+// MaxFrameSize keeps the high byte of the frame length zero, which is how
+// the server tells binary connections from text ones.
+const (
+	frameLengthSize     = 4
+	fieldLengthSize     = 4
+	DefaultMaxFrameSize = 1 << 20
+	MaxFrameSize        = 1<<24 - 1
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrBadFrame      = errors.New("malformed frame")
+)
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Encode(writer io.Writer, command Command) error {
+	return writeFrame(writer, command.CommandName(), command.Encode()...)
+}
+
+func (binaryCodec) Decode(reader *bufio.Reader, maxSize int) (Command, error) {
+	name, fields, err := readFrame(reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return decode(name, fields, strings.Join(fields, " "))
+}
+
+func writeFrame(writer io.Writer, name string, fields ...string) error {
+	if len(name) > 0xff {
+		return ErrBadFrame
+	}
+	size := 1 + len(name)
+	for _, field := range fields {
+		size += fieldLengthSize + len(field)
+	}
+	if size > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, frameLengthSize+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	offset := frameLengthSize
+	buf[offset] = byte(len(name))
+	offset++
+	offset += copy(buf[offset:], name)
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(buf[offset:], uint32(len(field)))
+		offset += fieldLengthSize
+		offset += copy(buf[offset:], field)
+	}
+	_, err := writer.Write(buf)
+	return err
+}
+
+func readFrame(reader io.Reader, maxSize int) (string, []string, error) {
+	header := make([]byte, frameLengthSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > uint32(maxSize) {
+		return "", nil, ErrFrameTooLarge
+	}
+	if size == 0 {
+		return "", nil, ErrBadFrame
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	nameLen := int(body[0])
+	if 1+nameLen > len(body) {
+		return "", nil, ErrBadFrame
+	}
+	name := string(body[1 : 1+nameLen])
+	var fields []string
+	for offset := 1 + nameLen; offset < len(body); {
+		if offset+fieldLengthSize > len(body) {
+			return "", nil, ErrBadFrame
+		}
+		fieldLen := int(binary.BigEndian.Uint32(body[offset:]))
+		offset += fieldLengthSize
+		if fieldLen > len(body)-offset {
+			return "", nil, ErrBadFrame
+		}
+		fields = append(fields, string(body[offset:offset+fieldLen]))
+		offset += fieldLen
+	}
+	return name, fields, nil
+}
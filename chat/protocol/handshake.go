@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Version is the protocol version spoken by this package. Clients that never
+// send HELLO are treated as LegacyVersion.
+const (
+	Version       = 6
+	MinVersion    = 1
+	LegacyVersion = 1
+)
+
+// Versions changing the encoding of existing commands, CommandWriter writes
+// them in the format of the peer's version so older clients keep working.
+const (
+	// MessageIDVersion added message ids and server timestamps to MESSAGE
+	// and the ACK reply to SEND.
+	MessageIDVersion = 3
+	// ErrorCodeVersion added error codes to ERROR.
+	ErrorCodeVersion = 4
+	// QuotedVersion quoted text fields, before it fields were joined with
+	// spaces as they are.
+	QuotedVersion = 5
+	// PresenceVersion added presence to USERS.
+	PresenceVersion = 6
+)
+
+const (
+	FeatureWhisper = "whisper"
+	FeatureRooms   = "rooms"
+	FeaturePing    = "ping"
+	FeatureFiles   = "files"
+	FeatureEdit    = "edit"
+	FeatureAuth    = "auth"
+	FeatureHistory = "history"
+	FeatureSearch  = "search"
+	FeatureNick    = "nick"
+)
+
+// Features lists the optional capabilities implemented by this package,
+// both sides advertise them in HELLO/WELCOME and use the intersection.
+var Features = []string{
+	FeatureWhisper,
+	FeatureRooms,
+	FeaturePing,
+	FeatureFiles,
+	FeatureEdit,
+	FeatureAuth,
+	FeatureHistory,
+	FeatureSearch,
+	FeatureNick,
+}
+
+func Negotiate(hello HelloCommand) (WelcomeCommand, error) {
+	version := hello.Version
+	if version > Version {
+		version = Version
+	}
+	if version < MinVersion {
+		return WelcomeCommand{}, fmt.Errorf("protocol version %d is not supported, minimal version is %d",
+			hello.Version, MinVersion)
+	}
+	var features []string
+	for _, feature := range hello.Features {
+		if HasFeature(Features, feature) {
+			features = append(features, feature)
+		}
+	}
+	return WelcomeCommand{
+		Version:  version,
+		Features: features,
+	}, nil
+}
+
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func splitFeatures(str string) []string {
+	var features []string
+	for _, feature := range strings.Split(str, ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"errors"
+)
+
+// HISTORY replays the recent messages of a room to a client that just got
+// its name, oldest first, in a single command so clients can tell the
+// backlog apart from new messages.
+type HistoryCommand struct {
+	Room     string           `json:"room"`
+	Messages []MessageCommand `json:"messages"`
+}
+
+func init() {
+	Register(HistoryCommand{})
+}
+
+func (HistoryCommand) CommandName() string {
+	return "HISTORY"
+}
+
+// Messages are encoded as a single field of quoted id, time, name and
+// message quadruples.
+func (c HistoryCommand) Encode() []string {
+	fields := make([]string, 0, 4*len(c.Messages))
+	for _, message := range c.Messages {
+		fields = append(fields, message.Encode()...)
+	}
+	return []string{c.Room, JoinFields(fields)}
+}
+
+func (HistoryCommand) Decode(fields []string) (Command, error) {
+	backlog, err := SplitFields(field(fields, 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(backlog)%4 != 0 {
+		return nil, errors.New("bad history backlog")
+	}
+	messages := make([]MessageCommand, 0, len(backlog)/4)
+	for i := 0; i < len(backlog); i += 4 {
+		message, err := MessageCommand{}.Decode(backlog[i : i+4])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message.(MessageCommand))
+	}
+	return HistoryCommand{
+		field(fields, 0),
+		messages,
+	}, nil
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+// JSON lines codec, one object per line:
+//
+//	{"command":"MESSAGE","payload":{"name":"bob","message":"hi"}}
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Command string          `json:"command"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(writer io.Writer, command Command) error {
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(jsonEnvelope{
+		Command: command.CommandName(),
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
+func (jsonCodec) Decode(reader *bufio.Reader, maxSize int) (Command, error) {
+	line, err := readLine(reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	var envelope jsonEnvelope
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return nil, BadCommand{
+			Line: string(line),
+			Err:  err,
+		}
+	}
+	registered, ok := Lookup(envelope.Command)
+	if !ok {
+		return nil, UnknownCommand{
+			Name: envelope.Command,
+			Line: string(line),
+		}
+	}
+	command := reflect.New(reflect.TypeOf(registered))
+	if len(envelope.Payload) > 0 {
+		if err := json.Unmarshal(envelope.Payload, command.Interface()); err != nil {
+			return nil, BadCommand{
+				Name: envelope.Command,
+				Line: string(line),
+				Err:  err,
+			}
+		}
+	}
+	// Decoding the fields once more applies the checks Decode does for the
+	// other codecs, like rejecting negative sizes, to JSON clients too.
+	return decode(envelope.Command, command.Elem().Interface().(Command).Encode(), string(line))
+}
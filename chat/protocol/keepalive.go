@@ -0,0 +1,44 @@
+package protocol
+
+// PING may be sent by either side, the peer must answer with PONG carrying
+// the same token.
+type PingCommand struct {
+	Token string `json:"token"`
+}
+
+type PongCommand struct {
+	Token string `json:"token"`
+}
+
+func init() {
+	Register(PingCommand{})
+	Register(PongCommand{})
+}
+
+func (PingCommand) CommandName() string {
+	return "PING"
+}
+
+func (c PingCommand) Encode() []string {
+	return []string{c.Token}
+}
+
+func (PingCommand) Decode(fields []string) (Command, error) {
+	return PingCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (PongCommand) CommandName() string {
+	return "PONG"
+}
+
+func (c PongCommand) Encode() []string {
+	return []string{c.Token}
+}
+
+func (PongCommand) Decode(fields []string) (Command, error) {
+	return PongCommand{
+		field(fields, 0),
+	}, nil
+}
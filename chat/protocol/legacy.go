@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// Downgrader is implemented by commands whose encoding changed since
+// MinVersion, Downgrade returns the command as peers speaking version
+// expect it.
+type Downgrader interface {
+	Downgrade(version int) Command
+}
+
+// The commands below are written to older peers only, they are not
+// registered so they are never read.
+
+// legacyMessageCommand is MESSAGE before MessageIDVersion.
+type legacyMessageCommand struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// legacyErrorCommand is ERROR before ErrorCodeVersion.
+type legacyErrorCommand struct {
+	Message string `json:"message"`
+}
+
+// legacyUsersCommand is USERS before QuotedVersion, a space separated list
+// of names.
+type legacyUsersCommand struct {
+	Users string `json:"users"`
+}
+
+// namesUsersCommand is USERS before PresenceVersion, a list of quoted names.
+type namesUsersCommand struct {
+	Users []string `json:"users"`
+}
+
+func (c MessageCommand) Downgrade(version int) Command {
+	if version < MessageIDVersion {
+		return legacyMessageCommand{
+			Name:    c.Name,
+			Message: c.Message,
+		}
+	}
+	return c
+}
+
+func (c ErrorCommand) Downgrade(version int) Command {
+	if version < ErrorCodeVersion {
+		return legacyErrorCommand{
+			Message: c.Message,
+		}
+	}
+	return c
+}
+
+func (c UsersCommand) Downgrade(version int) Command {
+	if version >= PresenceVersion {
+		return c
+	}
+	names := make([]string, len(c.Users))
+	for i, user := range c.Users {
+		names[i] = user.Name
+	}
+	if version < QuotedVersion {
+		return legacyUsersCommand{
+			Users: strings.Join(names, " "),
+		}
+	}
+	return namesUsersCommand{
+		Users: names,
+	}
+}
+
+func (legacyMessageCommand) CommandName() string {
+	return "MESSAGE"
+}
+
+func (c legacyMessageCommand) Encode() []string {
+	return []string{c.Name, c.Message}
+}
+
+func (legacyMessageCommand) Decode(fields []string) (Command, error) {
+	return legacyMessageCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func (legacyErrorCommand) CommandName() string {
+	return "ERROR"
+}
+
+func (c legacyErrorCommand) Encode() []string {
+	return []string{c.Message}
+}
+
+func (legacyErrorCommand) Decode(fields []string) (Command, error) {
+	return legacyErrorCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (legacyUsersCommand) CommandName() string {
+	return "USERS"
+}
+
+func (c legacyUsersCommand) Encode() []string {
+	return []string{c.Users}
+}
+
+func (legacyUsersCommand) Decode(fields []string) (Command, error) {
+	return legacyUsersCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (namesUsersCommand) CommandName() string {
+	return "USERS"
+}
+
+func (c namesUsersCommand) Encode() []string {
+	return []string{JoinFields(c.Users)}
+}
+
+func (namesUsersCommand) Decode(fields []string) (Command, error) {
+	names, err := SplitFields(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	return namesUsersCommand{
+		names,
+	}, nil
+}
+
+// encodeLegacyText joins fields the way the text codec did before
+// QuotedVersion. Line breaks can not be represented, they are replaced with
+// spaces so they do not end the line early.
+func encodeLegacyText(fields []string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(strings.Join(fields, " "))
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+const (
+	StatusOnline = "online"
+	StatusAway   = "away"
+	StatusBusy   = "busy"
+
+	MaxStatusTextLength = 64
+)
+
+type UserInfo struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Text   string `json:"text,omitempty"`
+}
+
+func (u UserInfo) String() string {
+	if u.Status == StatusOnline || u.Status == "" {
+		return u.Name
+	}
+	if u.Text == "" {
+		return fmt.Sprintf("%s [%s]", u.Name, u.Status)
+	}
+	return fmt.Sprintf("%s [%s: %s]", u.Name, u.Status, u.Text)
+}
+
+type StatusCommand struct {
+	Status string `json:"status"`
+	Text   string `json:"text"`
+}
+
+func init() {
+	Register(StatusCommand{})
+}
+
+func (StatusCommand) CommandName() string {
+	return "STATUS"
+}
+
+func (c StatusCommand) Encode() []string {
+	return []string{c.Status, c.Text}
+}
+
+func (StatusCommand) Decode(fields []string) (Command, error) {
+	return StatusCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func ValidStatus(status, text string) error {
+	switch status {
+	case StatusOnline, StatusAway, StatusBusy:
+	default:
+		return fmt.Errorf("status must be one of %v, %v or %v", StatusOnline, StatusAway, StatusBusy)
+	}
+	if len([]rune(text)) > MaxStatusTextLength || containsControl(text) {
+		return fmt.Errorf("status text must be at most %d printable characters", MaxStatusTextLength)
+	}
+	return nil
+}
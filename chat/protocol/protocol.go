@@ -5,103 +5,377 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type SendCommand struct {
-	Message string
+	Message string `json:"message"`
 }
 
 type NameCommand struct {
-	Name string
+	Name string `json:"name"`
 
 }
 
 type MessageCommand struct {
-	Name    string
-	Message string
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
 }
 
 type UsersCommand struct {
-	Users string
+	Users []UserInfo `json:"users"`
 }
 
-type UnknownCommand interface {
-	Error() string
+type HelloCommand struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+type WelcomeCommand struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+type RejectCommand struct {
+	Reason string `json:"reason"`
+}
+
+type WhisperCommand struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+type PrivateMessageCommand struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+type AckCommand struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+func init() {
+	Register(SendCommand{})
+	Register(MessageCommand{})
+	Register(NameCommand{})
+	Register(UsersCommand{})
+	Register(HelloCommand{})
+	Register(WelcomeCommand{})
+	Register(RejectCommand{})
+	Register(WhisperCommand{})
+	Register(PrivateMessageCommand{})
+	Register(AckCommand{})
+}
+
+func (SendCommand) CommandName() string {
+	return "SEND"
+}
+
+func (c SendCommand) Encode() []string {
+	return []string{c.Message}
+}
+
+func (SendCommand) Decode(fields []string) (Command, error) {
+	return SendCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (MessageCommand) CommandName() string {
+	return "MESSAGE"
+}
+
+func (c MessageCommand) Encode() []string {
+	return []string{formatID(c.ID), formatTime(c.Time), c.Name, c.Message}
+}
+
+func (MessageCommand) Decode(fields []string) (Command, error) {
+	id, err := parseID(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTime(field(fields, 1))
+	if err != nil {
+		return nil, err
+	}
+	return MessageCommand{
+		id,
+		t,
+		field(fields, 2),
+		field(fields, 3),
+	}, nil
+}
+
+func (NameCommand) CommandName() string {
+	return "NAME"
+}
+
+func (c NameCommand) Encode() []string {
+	return []string{c.Name}
+}
+
+func (NameCommand) Decode(fields []string) (Command, error) {
+	return NameCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (UsersCommand) CommandName() string {
+	return "USERS"
+}
+
+// Users are encoded as a single field of quoted name, status and status
+// text triples.
+func (c UsersCommand) Encode() []string {
+	fields := make([]string, 0, 3*len(c.Users))
+	for _, user := range c.Users {
+		fields = append(fields, user.Name, user.Status, user.Text)
+	}
+	return []string{JoinFields(fields)}
+}
+
+func (UsersCommand) Decode(fields []string) (Command, error) {
+	roster, err := SplitFields(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	if len(roster)%3 != 0 {
+		return nil, errors.New("bad users roster")
+	}
+	users := make([]UserInfo, 0, len(roster)/3)
+	for i := 0; i < len(roster); i += 3 {
+		users = append(users, UserInfo{
+			Name:   roster[i],
+			Status: roster[i+1],
+			Text:   roster[i+2],
+		})
+	}
+	return UsersCommand{
+		users,
+	}, nil
+}
+
+func (HelloCommand) CommandName() string {
+	return "HELLO"
+}
+
+func (c HelloCommand) Encode() []string {
+	return []string{strconv.Itoa(c.Version), strings.Join(c.Features, ",")}
+}
+
+func (HelloCommand) Decode(fields []string) (Command, error) {
+	version, err := strconv.Atoi(field(fields, 0))
+	if err != nil {
+		return nil, errors.New("bad protocol version")
+	}
+	return HelloCommand{
+		version,
+		splitFeatures(field(fields, 1)),
+	}, nil
+}
+
+func (WelcomeCommand) CommandName() string {
+	return "WELCOME"
+}
+
+func (c WelcomeCommand) Encode() []string {
+	return []string{strconv.Itoa(c.Version), strings.Join(c.Features, ",")}
+}
+
+func (WelcomeCommand) Decode(fields []string) (Command, error) {
+	version, err := strconv.Atoi(field(fields, 0))
+	if err != nil {
+		return nil, errors.New("bad protocol version")
+	}
+	return WelcomeCommand{
+		version,
+		splitFeatures(field(fields, 1)),
+	}, nil
+}
+
+func (RejectCommand) CommandName() string {
+	return "REJECT"
+}
+
+func (c RejectCommand) Encode() []string {
+	return []string{c.Reason}
+}
+
+func (RejectCommand) Decode(fields []string) (Command, error) {
+	return RejectCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (WhisperCommand) CommandName() string {
+	return "WHISPER"
+}
+
+func (c WhisperCommand) Encode() []string {
+	return []string{c.To, c.Message}
+}
+
+func (WhisperCommand) Decode(fields []string) (Command, error) {
+	return WhisperCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
+
+func (PrivateMessageCommand) CommandName() string {
+	return "PRIVATE"
+}
+
+func (c PrivateMessageCommand) Encode() []string {
+	return []string{c.From, c.To, c.Message}
+}
+
+func (PrivateMessageCommand) Decode(fields []string) (Command, error) {
+	return PrivateMessageCommand{
+		field(fields, 0),
+		field(fields, 1),
+		field(fields, 2),
+	}, nil
+}
+
+func (AckCommand) CommandName() string {
+	return "ACK"
+}
+
+func (c AckCommand) Encode() []string {
+	return []string{formatID(c.ID), formatTime(c.Time)}
+}
+
+func (AckCommand) Decode(fields []string) (Command, error) {
+	id, err := parseID(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTime(field(fields, 1))
+	if err != nil {
+		return nil, err
+	}
+	return AckCommand{
+		id,
+		t,
+	}, nil
 }
 
 type CommandWriter struct {
-	writer io.Writer
+	writer  io.Writer
+	codec   Codec
+	version int32
 }
 
 func NewCommandWriter(writer io.Writer) *CommandWriter {
 	return &CommandWriter{
-		writer: writer,
+		writer:  writer,
+		codec:   TextCodec,
+		version: Version,
 	}
 }
 
-func (w *CommandWriter) writeString(msg string) error {
-	_, err := w.writer.Write([]byte(msg))
-	return err
+func (w *CommandWriter) SetCodec(codec Codec) {
+	w.codec = codec
 }
 
-func (w *CommandWriter) Write(command interface{}) error {
-	var err error
-	switch v := command.(type) {
-	case SendCommand:
-		err = w.writeString(fmt.Sprintf("SEND %v\n", v.Message))
-	case MessageCommand:
-		err = w.writeString(fmt.Sprintf("MESSAGE %v %v\n", v.Name, v.Message))
-	case NameCommand:
-		err = w.writeString(fmt.Sprintf("NAME %v\n", v.Name))
-	case UsersCommand:
-		err = w.writeString(fmt.Sprintf("USERS %v\n", v.Users))
+// SetVersion makes Write encode commands the way peers speaking version
+// expect them, it may be called while another goroutine writes.
+func (w *CommandWriter) SetVersion(version int) {
+	atomic.StoreInt32(&w.version, int32(version))
+}
+
+func (w *CommandWriter) Write(command Command) error {
+	if err := checkRegistered(command); err != nil {
+		return err
+	}
+	version := int(atomic.LoadInt32(&w.version))
+	if downgrader, ok := command.(Downgrader); ok && version < Version {
+		command = downgrader.Downgrade(version)
+	}
+	if w.codec == TextCodec && version < QuotedVersion {
+		line := fmt.Sprintf("%v %v\n", command.CommandName(), encodeLegacyText(command.Encode()))
+		_, err := io.WriteString(w.writer, line)
+		return err
 	}
-	return err
+	return w.codec.Encode(w.writer, command)
 }
 
 type CommandReader struct {
-	reader *bufio.Reader
+	reader       *bufio.Reader
+	codec        Codec
+	maxFrameSize int
 }
 
 func NewCommandReader(reader io.Reader) *CommandReader {
 	return &CommandReader{
-		reader: bufio.NewReader(reader),
+		reader:       bufio.NewReader(reader),
+		codec:        TextCodec,
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+func (r *CommandReader) SetCodec(codec Codec) {
+	r.codec = codec
+}
+
+// SetMaxFrameSize limits the size of a single line or binary frame, Read
+// returns ErrFrameTooLarge for anything longer.
+func (r *CommandReader) SetMaxFrameSize(size int) {
+	if size > MaxFrameSize {
+		size = MaxFrameSize
+	}
+	r.maxFrameSize = size
+}
+
+// DetectCodec peeks at the first bytes of the stream and switches the reader
+// to the codec the peer is speaking.
+func (r *CommandReader) DetectCodec() (Codec, error) {
+	codec, err := detectCodec(r.reader)
+	if err == nil {
+		r.codec = codec
+	}
+	return codec, err
+}
+
+func (r *CommandReader) Read() (Command, error) {
+	return r.codec.Decode(r.reader, r.maxFrameSize)
+}
+
+func field(fields []string, i int) string {
+	if i < len(fields) {
+		return fields[i]
 	}
+	return ""
+}
+
+func formatID(id uint64) string {
+	return strconv.FormatUint(id, 10)
 }
 
-func (r *CommandReader) Read() (interface{}, error) {
-	bufstr, err := r.reader.ReadString('\n')
+func parseID(str string) (uint64, error) {
+	id, err := strconv.ParseUint(str, 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, errors.New("bad message id")
+	}
+	return id, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(str string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}, errors.New("bad timestamp")
 	}
-	bufslice := strings.Split(bufstr[:len(bufstr)-1], " ")
-	commandName := bufslice[0]
-	switch commandName {
-	case "SEND":
-		message := strings.Join(bufslice[1:], " ")
-		return SendCommand{
-			message,
-		}, nil
-	case "MESSAGE":
-		user := bufslice[1]
-		message := strings.Join(bufslice[2:], " ")
-		return MessageCommand{
-			user,
-			message,
-		}, nil
-	case "NAME":
-		name := bufslice[1]
-		return NameCommand{
-			name,
-		}, nil
-	case "USERS":
-		users := strings.Join(bufslice[1:], " ")
-		return UsersCommand{
-			users,
-		}, nil
-	}
-	log.Printf("Unknown command: %v", commandName)
-	return nil, errors.New("unknown command")
+	return t, nil
 }
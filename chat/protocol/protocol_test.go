@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden transcripts in testdata")
+
+var (
+	sent     = time.Date(2020, 5, 17, 14, 3, 9, 120000000, time.UTC)
+	received = time.Date(2020, 5, 17, 14, 3, 10, 0, time.UTC)
+)
+
+// commands holds an example of every registered command, with quotes,
+// spaces and line breaks in the text fields so they are escaped by every
+// codec.
+var commands = []Command{
+	HelloCommand{Version: Version, Features: []string{FeatureWhisper, FeatureRooms, FeatureFiles}},
+	WelcomeCommand{Version: Version, Features: []string{FeatureWhisper, FeatureRooms}},
+	RejectCommand{Reason: "unsupported version 99"},
+	SendCommand{Message: `hello "world"` + "\nsecond line"},
+	NameCommand{Name: "bob"},
+	MessageCommand{ID: 42, Time: sent, Name: "alice smith", Message: "hi bob, \\o/"},
+	AckCommand{ID: 42, Time: sent},
+	UsersCommand{Users: []UserInfo{
+		{Name: "alice smith", Status: StatusOnline},
+		{Name: "bob", Status: StatusAway, Text: "back at 5"},
+	}},
+	WhisperCommand{To: "alice smith", Message: "psst"},
+	PrivateMessageCommand{From: "bob", To: "alice smith", Message: "psst"},
+	RenameCommand{From: "bob", To: "robert"},
+	StatusCommand{Status: StatusBusy, Text: "in a meeting"},
+	ErrorCommand{Code: CodeNameTaken, Message: "name bob is taken"},
+	PingCommand{Token: "17"},
+	PongCommand{Token: "17"},
+	AuthCommand{Name: "alice", Password: "correct horse"},
+	RegisterCommand{Name: "alice", Password: "correct horse"},
+	AuthedCommand{Name: "alice"},
+	EditCommand{ID: 42, Message: "hi robert"},
+	DeleteCommand{ID: 42},
+	JoinCommand{Room: "go"},
+	PartCommand{Room: "go"},
+	ListCommand{},
+	RoomsCommand{Rooms: []RoomInfo{{Name: "general", Users: 3}, {Name: "go", Users: 1}}},
+	HistoryCommand{Room: "go", Messages: []MessageCommand{
+		{ID: 40, Time: sent, Name: "alice smith", Message: "first"},
+		{ID: 41, Time: received, Name: "bob", Message: "second \"one\""},
+	}},
+	SearchCommand{Name: "bob", Room: "go", Since: sent, Until: received, Text: "second"},
+	ResultsCommand{Messages: []FoundMessage{
+		{ID: 41, Time: received, Room: "go", Name: "bob", Message: "second \"one\""},
+	}},
+	FileOfferCommand{ID: "f1", To: "alice smith", From: "bob", Size: 5, Name: "notes.txt"},
+	FileAcceptCommand{ID: "f1", From: "alice smith"},
+	FileChunkCommand{ID: "f1", To: "alice smith", Offset: 0, Data: []byte("hi\x00\n!")},
+}
+
+var codecs = []Codec{TextCodec, BinaryCodec, JSONCodec}
+
+func TestCommandsCoverRegistry(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, command := range commands {
+		covered[command.CommandName()] = true
+	}
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	for name := range registry {
+		if !covered[name] {
+			t.Errorf("no example of %v in the golden transcripts", name)
+		}
+	}
+}
+
+// transcript renders what the codec writes as a text file, binary frames are
+// dumped as one hex line each.
+func transcript(t *testing.T, codec Codec) []byte {
+	var buf bytes.Buffer
+	for _, command := range commands {
+		var frame bytes.Buffer
+		writer := NewCommandWriter(&frame)
+		writer.SetCodec(codec)
+		if err := writer.Write(command); err != nil {
+			t.Fatalf("%v: writing %v: %v", codec.Name(), command.CommandName(), err)
+		}
+		if codec == BinaryCodec {
+			buf.WriteString(hex.EncodeToString(frame.Bytes()) + "\n")
+		} else {
+			buf.Write(frame.Bytes())
+		}
+	}
+	return buf.Bytes()
+}
+
+// wire converts a transcript back to what is sent on the connection.
+func wire(t *testing.T, codec Codec, transcript []byte) []byte {
+	if codec != BinaryCodec {
+		return transcript
+	}
+	var buf bytes.Buffer
+	for _, line := range strings.Fields(string(transcript)) {
+		frame, err := hex.DecodeString(line)
+		if err != nil {
+			t.Fatalf("binary transcript: %v", err)
+		}
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func TestGoldenTranscripts(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			golden := filepath.Join("testdata", codec.Name()+".txt")
+			got := transcript(t, codec)
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("encoding differs from %v, run go test -update if the change is intended:\n%s", golden, got)
+			}
+
+			reader := NewCommandReader(bytes.NewReader(wire(t, codec, want)))
+			reader.SetCodec(codec)
+			for _, command := range commands {
+				read, err := reader.Read()
+				if err != nil {
+					t.Fatalf("reading %v: %v", command.CommandName(), err)
+				}
+				if !reflect.DeepEqual(read, command) {
+					t.Errorf("read %#v, want %#v", read, command)
+				}
+			}
+			if _, err := reader.Read(); err != io.EOF {
+				t.Errorf("read past the transcript: %v", err)
+			}
+		})
+	}
+}
+
+func TestDetectCodec(t *testing.T) {
+	for _, codec := range codecs {
+		reader := NewCommandReader(bytes.NewReader(transcript(t, codec)))
+		if codec == BinaryCodec {
+			reader = NewCommandReader(bytes.NewReader(wire(t, codec, transcript(t, codec))))
+		}
+		detected, err := reader.DetectCodec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detected != codec {
+			t.Errorf("detected %v, want %v", detected.Name(), codec.Name())
+		}
+	}
+}
+
+// FuzzCommandReader feeds the same bytes to every codec. Reading must never
+// panic, and every command read must survive being written and read again.
+func FuzzCommandReader(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range codecs {
+			reader := NewCommandReader(bytes.NewReader(data))
+			reader.SetCodec(codec)
+			reader.SetMaxFrameSize(1 << 16)
+			for {
+				command, err := reader.Read()
+				if err == io.EOF || err == io.ErrUnexpectedEOF ||
+					err == ErrFrameTooLarge || err == ErrBadFrame {
+					break
+				}
+				if err != nil {
+					continue
+				}
+				roundTrip(t, codec, command)
+			}
+		}
+	})
+}
+
+func roundTrip(t *testing.T, codec Codec, command Command) {
+	var buf bytes.Buffer
+	writer := NewCommandWriter(&buf)
+	writer.SetCodec(codec)
+	if err := writer.Write(command); err != nil {
+		t.Fatalf("%v: writing %#v: %v", codec.Name(), command, err)
+	}
+	reader := NewCommandReader(bufio.NewReader(&buf))
+	reader.SetCodec(codec)
+	read, err := reader.Read()
+	if err != nil {
+		t.Fatalf("%v: reading back %#v: %v", codec.Name(), command, err)
+	}
+	if !reflect.DeepEqual(read, command) {
+		t.Fatalf("%v: read back %#v, want %#v", codec.Name(), read, command)
+	}
+}
@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const MaxNameLength = 32
+
+var ErrUnterminatedQuote = errors.New("unterminated quoted field")
+
+// Quote returns the field as a single text codec token.
+func Quote(field string) string {
+	if field != "" && !strings.ContainsAny(field, " \"\\") && !containsControl(field) {
+		return field
+	}
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(field); i++ {
+		switch c := field[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// JoinFields quotes every field and joins them with spaces, SplitFields
+// reverses it.
+func JoinFields(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = Quote(field)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func SplitFields(str string) ([]string, error) {
+	var fields []string
+	for str != "" {
+		field, rest, err := NextField(str)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		str = rest
+	}
+	return fields, nil
+}
+
+// NextField cuts the first bare or quoted token off the string and returns
+// it unquoted together with the rest after the separating space.
+func NextField(str string) (string, string, error) {
+	if !strings.HasPrefix(str, `"`) {
+		if i := strings.IndexByte(str, ' '); i >= 0 {
+			return str[:i], str[i+1:], nil
+		}
+		return str, "", nil
+	}
+	var buf strings.Builder
+	for i := 1; i < len(str); i++ {
+		switch c := str[i]; c {
+		case '"':
+			rest := str[i+1:]
+			if rest != "" && rest[0] != ' ' {
+				return "", "", fmt.Errorf("unexpected %q after quoted field", rest[0])
+			}
+			return buf.String(), strings.TrimPrefix(rest, " "), nil
+		case '\\':
+			if i+1 == len(str) {
+				return "", "", ErrUnterminatedQuote
+			}
+			i++
+			buf.WriteString(unescape(str[i]))
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", "", ErrUnterminatedQuote
+}
+
+func escapeTail(field string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(field)
+}
+
+func unescapeTail(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var buf strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+1 < len(field) && strings.IndexByte(`\nrt"`, field[i+1]) >= 0 {
+			i++
+			buf.WriteString(unescape(field[i]))
+		} else {
+			buf.WriteByte(field[i])
+		}
+	}
+	return buf.String()
+}
+
+func unescape(c byte) string {
+	switch c {
+	case 'n':
+		return "\n"
+	case 'r':
+		return "\r"
+	case 't':
+		return "\t"
+	}
+	return string(c)
+}
+
+// Fields of the text codec are separated by a single space. Every field but
+// the last one is written bare when it contains no spaces, quotes, backslashes
+// or control characters and double-quoted with backslash escapes otherwise.
+// The last field takes the rest of the line as is, only backslashes and line
+// breaks are escaped in it, so plain text from old clients still decodes.
+//
+//	MESSAGE 1 2020-05-01T10:00:00Z "John Smith" hello "world"
+func encodeText(fields []string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	last := len(fields) - 1
+	return strings.TrimPrefix(JoinFields(fields[:last])+" "+escapeTail(fields[last]), " ")
+}
+
+func decodeText(str string, arity int) ([]string, error) {
+	var fields []string
+	for len(fields) < arity-1 && str != "" {
+		field, rest, err := NextField(str)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		str = rest
+	}
+	if arity > 0 && (str != "" || len(fields) == arity-1) {
+		fields = append(fields, unescapeTail(str))
+	}
+	return fields, nil
+}
+
+func containsControl(str string) bool {
+	for _, r := range str {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidName checks the rules for user names: 1 to MaxNameLength letters,
+// digits, spaces, '_', '-' or '.', starting with a letter or a digit and
+// without leading, trailing or repeated spaces.
+func ValidName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLength {
+		return fmt.Errorf("name must be 1 to %d characters long", MaxNameLength)
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("name must be valid UTF-8")
+	}
+	first, _ := utf8.DecodeRuneInString(name)
+	if !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		return errors.New("name must start with a letter or a digit")
+	}
+	if strings.HasSuffix(name, " ") || strings.Contains(name, "  ") {
+		return errors.New("name must not end with a space or contain repeated spaces")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" _-.", r) {
+			return fmt.Errorf("name must not contain %q, allowed are letters, digits, spaces, '_', '-' and '.'", r)
+		}
+	}
+	return nil
+}
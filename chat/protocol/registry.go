@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Command is implemented by every message of the chat protocol. Encode and
+// Decode convert it to and from the list of fields carried by the codecs,
+// Decode is called on the registered value and must not modify it. Decode
+// also rejects invalid fields, every codec runs commands read through it.
+type Command interface {
+	CommandName() string
+	Encode() []string
+	Decode(fields []string) (Command, error)
+}
+
+// UnknownCommand is returned by CommandReader.Read for commands missing in
+// the registry.
+type UnknownCommand struct {
+	Name string
+	Line string
+}
+
+func (e UnknownCommand) Error() string {
+	return fmt.Sprintf("unknown command: %v", e.Name)
+}
+
+var (
+	registry      = make(map[string]Command)
+	registryMutex = &sync.RWMutex{}
+)
+
+// Register makes the command known to all codecs. It panics if a command
+// with the same name is already registered.
+func Register(command Command) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[command.CommandName()]; ok {
+		panic(fmt.Sprintf("protocol: command %v registered twice", command.CommandName()))
+	}
+	registry[command.CommandName()] = command
+}
+
+func Lookup(name string) (Command, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	command, ok := registry[name]
+	return command, ok
+}
+
+func checkRegistered(command Command) error {
+	registered, ok := Lookup(command.CommandName())
+	if !ok || reflect.TypeOf(registered) != reflect.TypeOf(command) {
+		return fmt.Errorf("unregistered command type %T", command)
+	}
+	return nil
+}
+
+// decode never panics, a panic in the Decode method of a registered command
+// is reported as BadCommand.
+func decode(name string, fields []string, line string) (decoded Command, err error) {
+	command, ok := Lookup(name)
+	if !ok {
+		return nil, UnknownCommand{
+			Name: name,
+			Line: line,
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			decoded, err = nil, BadCommand{
+				Name: name,
+				Line: line,
+				Err:  fmt.Errorf("panic: %v", r),
+			}
+		}
+	}()
+	decoded, err = command.Decode(fields)
+	if err != nil {
+		return nil, BadCommand{
+			Name: name,
+			Line: line,
+			Err:  err,
+		}
+	}
+	return decoded, nil
+}
+
+// textArity is the number of fields the text codec splits a line into, the
+// last field takes the rest of the line.
+func textArity(name string) int {
+	if command, ok := Lookup(name); ok {
+		return len(command.Encode())
+	}
+	return 1
+}
@@ -0,0 +1,27 @@
+package protocol
+
+// RENAME tells a room that a user changed its name. It also answers the
+// first NAME of a client, with an empty From, to that client only.
+type RenameCommand struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func init() {
+	Register(RenameCommand{})
+}
+
+func (RenameCommand) CommandName() string {
+	return "RENAME"
+}
+
+func (c RenameCommand) Encode() []string {
+	return []string{c.From, c.To}
+}
+
+func (RenameCommand) Decode(fields []string) (Command, error) {
+	return RenameCommand{
+		field(fields, 0),
+		field(fields, 1),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const LobbyRoom = "lobby"
+
+type JoinCommand struct {
+	Room string `json:"room"`
+}
+
+type PartCommand struct {
+	Room string `json:"room"`
+}
+
+type ListCommand struct{}
+
+type RoomInfo struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+type RoomsCommand struct {
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+func init() {
+	Register(JoinCommand{})
+	Register(PartCommand{})
+	Register(ListCommand{})
+	Register(RoomsCommand{})
+}
+
+func (JoinCommand) CommandName() string {
+	return "JOIN"
+}
+
+func (c JoinCommand) Encode() []string {
+	return []string{c.Room}
+}
+
+func (JoinCommand) Decode(fields []string) (Command, error) {
+	return JoinCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (PartCommand) CommandName() string {
+	return "PART"
+}
+
+func (c PartCommand) Encode() []string {
+	return []string{c.Room}
+}
+
+func (PartCommand) Decode(fields []string) (Command, error) {
+	return PartCommand{
+		field(fields, 0),
+	}, nil
+}
+
+func (ListCommand) CommandName() string {
+	return "LIST"
+}
+
+func (ListCommand) Encode() []string {
+	return nil
+}
+
+func (ListCommand) Decode(fields []string) (Command, error) {
+	return ListCommand{}, nil
+}
+
+func (RoomsCommand) CommandName() string {
+	return "ROOMS"
+}
+
+// Rooms are encoded as a single field of space separated name:users pairs.
+func (c RoomsCommand) Encode() []string {
+	rooms := make([]string, len(c.Rooms))
+	for i, room := range c.Rooms {
+		rooms[i] = fmt.Sprintf("%v:%d", room.Name, room.Users)
+	}
+	return []string{strings.Join(rooms, " ")}
+}
+
+func (RoomsCommand) Decode(fields []string) (Command, error) {
+	var rooms []RoomInfo
+	for _, pair := range strings.Fields(field(fields, 0)) {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("bad room entry: %v", pair)
+		}
+		users, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad room entry: %v", pair)
+		}
+		rooms = append(rooms, RoomInfo{
+			Name:  pair[:i],
+			Users: users,
+		})
+	}
+	return RoomsCommand{
+		rooms,
+	}, nil
+}
+
+func ValidRoomName(room string) error {
+	if room == "" || len(room) > 32 {
+		return fmt.Errorf("room name must be 1 to 32 characters long")
+	}
+	if strings.ContainsAny(room, " \t\r\n:,") {
+		return fmt.Errorf("room name must not contain spaces, ':' or ','")
+	}
+	// '#' addresses a room where a user name is expected, as in file offers.
+	if strings.HasPrefix(room, "#") {
+		return fmt.Errorf("room name must not start with '#'")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+// SEARCH looks up messages in the server's transcript, empty fields and zero
+// times match everything. The server answers with RESULTS, newest matches
+// last.
+type SearchCommand struct {
+	Name  string    `json:"name"`
+	Room  string    `json:"room"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	Text  string    `json:"text"`
+}
+
+type FoundMessage struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
+}
+
+type ResultsCommand struct {
+	Messages []FoundMessage `json:"messages"`
+}
+
+func init() {
+	Register(SearchCommand{})
+	Register(ResultsCommand{})
+}
+
+func (SearchCommand) CommandName() string {
+	return "SEARCH"
+}
+
+func (c SearchCommand) Encode() []string {
+	return []string{c.Name, c.Room, formatOptionalTime(c.Since), formatOptionalTime(c.Until), c.Text}
+}
+
+func (SearchCommand) Decode(fields []string) (Command, error) {
+	since, err := parseOptionalTime(field(fields, 2))
+	if err != nil {
+		return nil, err
+	}
+	until, err := parseOptionalTime(field(fields, 3))
+	if err != nil {
+		return nil, err
+	}
+	return SearchCommand{
+		field(fields, 0),
+		field(fields, 1),
+		since,
+		until,
+		field(fields, 4),
+	}, nil
+}
+
+func (ResultsCommand) CommandName() string {
+	return "RESULTS"
+}
+
+// Messages are encoded as a single field of quoted id, time, room, name and
+// message quintuples.
+func (c ResultsCommand) Encode() []string {
+	fields := make([]string, 0, 5*len(c.Messages))
+	for _, message := range c.Messages {
+		fields = append(fields, formatID(message.ID), formatTime(message.Time),
+			message.Room, message.Name, message.Message)
+	}
+	return []string{JoinFields(fields)}
+}
+
+func (ResultsCommand) Decode(fields []string) (Command, error) {
+	results, err := SplitFields(field(fields, 0))
+	if err != nil {
+		return nil, err
+	}
+	if len(results)%5 != 0 {
+		return nil, errors.New("bad search results")
+	}
+	messages := make([]FoundMessage, 0, len(results)/5)
+	for i := 0; i < len(results); i += 5 {
+		id, err := parseID(results[i])
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseTime(results[i+1])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, FoundMessage{
+			ID:      id,
+			Time:    t,
+			Room:    results[i+2],
+			Name:    results[i+3],
+			Message: results[i+4],
+		})
+	}
+	return ResultsCommand{
+		messages,
+	}, nil
+}
+
+// ValidSearch checks the time range of a search.
+func ValidSearch(search SearchCommand) error {
+	if !search.Since.IsZero() && !search.Until.IsZero() && !search.Since.Before(search.Until) {
+		return errors.New("search range must start before it ends")
+	}
+	return nil
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return formatTime(t)
+}
+
+func parseOptionalTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	return parseTime(str)
+}
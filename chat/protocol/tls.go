@@ -0,0 +1,13 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Fingerprint formats the SHA-256 digest of a DER encoded certificate the
+// way both the server log and the client's known hosts file show it.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -1,21 +1,42 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/LeadNess/net-tools/chat/server"
 	"github.com/LeadNess/net-tools/chat/tui"
 )
 
 func main()  {
-	server := tui.RunServerUI()
-	if server == nil {
+	chatServer := tui.RunServerUI()
+	if chatServer == nil {
 		os.Exit(0)
 	}
-	ui := tui.ServerLogsUI(server)
-	go server.Start()
-	defer server.Close()
+	ctx, shutdown := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		shutdown()
+		// A second signal does not wait for clients.
+		<-signals
+		os.Exit(1)
+	}()
+
+	ui := tui.ServerLogsUI(chatServer, shutdown)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- chatServer.Start(ctx)
+		ui.Quit()
+	}()
 	if err := ui.Run(); err != nil {
 		log.Fatal(err)
 	}
+	if err := <-stopped; err != context.Canceled && err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	DefaultUserStoreFile = "users.db"
+
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+)
+
+var (
+	errAuthFailed    = errors.New("wrong name or password")
+	errNameReserved  = errors.New("name is registered, log in with a password to use it")
+	errAlreadyExists = errors.New("name is already registered")
+)
+
+// userStore keeps registered accounts in a file with one quoted
+// "name hash" pair per line, it is read on first use and only appended to.
+type userStore struct {
+	path   string
+	loaded bool
+	users  map[string]account
+	mutex  *sync.Mutex
+}
+
+type account struct {
+	name string
+	hash string
+}
+
+func newUserStore(path string) *userStore {
+	return &userStore{
+		path:  path,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// SetUserStore sets the file registered accounts are kept in.
+func (s *TcpChatServer) SetUserStore(path string) {
+	s.accounts = newUserStore(path)
+}
+
+func accountKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func (u *userStore) load() error {
+	if u.loaded {
+		return nil
+	}
+	users := make(map[string]account)
+	file, err := os.Open(u.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields, err := protocol.SplitFields(scanner.Text())
+			if err != nil || len(fields) != 2 {
+				return fmt.Errorf("%s: malformed line %q", u.path, scanner.Text())
+			}
+			users[accountKey(fields[0])] = account{name: fields[0], hash: fields[1]}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	u.users = users
+	u.loaded = true
+	return nil
+}
+
+// registered reports whether name belongs to an account, names differing
+// only in case are the same account.
+func (u *userStore) registered(name string) (bool, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err := u.load(); err != nil {
+		return false, err
+	}
+	_, ok := u.users[accountKey(name)]
+	return ok, nil
+}
+
+// authenticate returns the registered spelling of name.
+func (u *userStore) authenticate(name, password string) (string, error) {
+	u.mutex.Lock()
+	if err := u.load(); err != nil {
+		u.mutex.Unlock()
+		return "", err
+	}
+	acc, ok := u.users[accountKey(name)]
+	u.mutex.Unlock()
+	if !ok {
+		// Hash anyway so unknown names take as long as wrong passwords.
+		hashPassword(password, make([]byte, passwordSaltSize), passwordIterations)
+		return "", errAuthFailed
+	}
+	if !checkPassword(acc.hash, password) {
+		return "", errAuthFailed
+	}
+	return acc.name, nil
+}
+
+func (u *userStore) register(name, password string) error {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash := hashPassword(password, salt, passwordIterations)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err := u.load(); err != nil {
+		return err
+	}
+	if _, ok := u.users[accountKey(name)]; ok {
+		return errAlreadyExists
+	}
+	file, err := os.OpenFile(u.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, protocol.JoinFields([]string{name, hash})); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	u.users[accountKey(name)] = account{name: name, hash: hash}
+	return nil
+}
+
+// hashPassword encodes a PBKDF2-HMAC-SHA256 key as
+// "pbkdf2-sha256$iterations$salt$key" with base64 salt and key.
+func hashPassword(password string, salt []byte, iterations int) string {
+	key := pbkdf2.Key([]byte(password), salt, iterations, passwordKeySize, sha256.New)
+	return strings.Join([]string{
+		passwordScheme,
+		strconv.Itoa(iterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$")
+}
+
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(hashPassword(password, salt, iterations)), []byte(encoded))
+}
+
+func (s *TcpChatServer) authenticate(client *client, cmd protocol.Command) {
+	var name string
+	var err error
+	switch v := cmd.(type) {
+	case protocol.AuthCommand:
+		name, err = s.accounts.authenticate(v.Name, v.Password)
+	case protocol.RegisterCommand:
+		name = v.Name
+		if err = protocol.ValidName(v.Name); err != nil {
+			client.writeError(protocol.CodeInvalidName, err.Error())
+			return
+		}
+		if err = protocol.ValidPassword(v.Password); err != nil {
+			client.writeError(protocol.CodeBadRequest, err.Error())
+			return
+		}
+		s.mutex.Lock()
+		inUse := s.nameInUse(client, v.Name)
+		s.mutex.Unlock()
+		if inUse {
+			client.writeError(protocol.CodeNameTaken, errNameInUse.Error())
+			return
+		}
+		err = s.accounts.register(v.Name, v.Password)
+	}
+	switch err {
+	case nil:
+	case errAuthFailed:
+		s.logs <- fmt.Sprintf("%s Failed login from %v",
+			time.Now().Format("15:04"), client.Addr)
+		client.writeError(protocol.CodeAuthFailed, err.Error())
+		return
+	case errAlreadyExists:
+		client.writeError(protocol.CodeNameTaken, err.Error())
+		return
+	default:
+		s.logs <- fmt.Sprintf("%s User store error: %v",
+			time.Now().Format("15:04"), err)
+		client.writeError(protocol.CodeInternal, "user store is unavailable")
+		return
+	}
+	// An account may only be logged in once.
+	old, named, err := s.claimName(client, name)
+	if err != nil {
+		client.writeError(protocol.CodeNameTaken, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	client.Account = name
+	s.mutex.Unlock()
+	s.logs <- fmt.Sprintf("%s Client %v logged in as %v",
+		time.Now().Format("15:04"), client.Addr, name)
+	client.send(protocol.AuthedCommand{Name: name})
+	s.renamed(client, old, named)
+}
+
+// checkReserved refuses registered names to everybody but their owner.
+func (s *TcpChatServer) checkReserved(client *client, name string) error {
+	if client.Account != "" && accountKey(client.Account) == accountKey(name) {
+		return nil
+	}
+	registered, err := s.accounts.registered(name)
+	if err != nil {
+		s.logs <- fmt.Sprintf("%s User store error: %v",
+			time.Now().Format("15:04"), err)
+		return err
+	}
+	if registered {
+		return errNameReserved
+	}
+	return nil
+}
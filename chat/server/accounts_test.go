@@ -0,0 +1,18 @@
+package server
+
+import "testing"
+
+// TestCheckPassword checks a hash stored by an earlier version of the user
+// store, they have to keep working.
+func TestCheckPassword(t *testing.T) {
+	const stored = "pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg$cBg8D2DungRB9k76szThf5ehfyBz991ay6PT8Srwk4M"
+	if !checkPassword(stored, "correct horse") {
+		t.Error("stored hash rejected")
+	}
+	if checkPassword(stored, "wrong horse") {
+		t.Error("wrong password accepted")
+	}
+	if hash := hashPassword("correct horse", []byte("0123456789abcdef"), 1000); hash != stored {
+		t.Errorf("hashed to %v, want %v", hash, stored)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const (
+	DefaultMaxFileSize = 10 << 20
+	fileOfferTTL       = 10 * time.Minute
+)
+
+type transfer struct {
+	offer      protocol.FileOfferCommand
+	sender     *client
+	recipients []*client
+	accepted   []*client
+	created    time.Time
+}
+
+func (s *TcpChatServer) SetMaxFileSize(size int64) {
+	s.maxFileSize = size
+}
+
+func (s *TcpChatServer) offerFile(sender *client, offer protocol.FileOfferCommand) {
+	if offer.ID == "" || offer.Name == "" {
+		sender.writeError(protocol.CodeBadRequest, "file offer must have an id and a name")
+		return
+	}
+	if offer.Size > s.maxFileSize {
+		sender.writeError(protocol.CodeNotPermitted,
+			fmt.Sprintf("file is too large, limit is %d bytes", s.maxFileSize))
+		return
+	}
+	var candidates []*client
+	if strings.HasPrefix(offer.To, "#") {
+		candidates = s.roomClients(strings.TrimPrefix(offer.To, "#"))
+	} else {
+		candidates = s.clientsByName(offer.To)
+	}
+	var recipients []*client
+	for _, recipient := range candidates {
+		if recipient != sender && recipient.Supports(protocol.FeatureFiles) {
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(recipients) == 0 {
+		sender.writeError(protocol.CodeNoSuchUser, fmt.Sprintf("nobody to send files to in %v", offer.To))
+		return
+	}
+	offer.From = sender.Name
+
+	s.transfersMutex.Lock()
+	for id, t := range s.transfers {
+		if time.Since(t.created) > fileOfferTTL {
+			delete(s.transfers, id)
+		}
+	}
+	if _, ok := s.transfers[offer.ID]; ok {
+		s.transfersMutex.Unlock()
+		sender.writeError(protocol.CodeBadRequest, fmt.Sprintf("file offer %v already exists", offer.ID))
+		return
+	}
+	s.transfers[offer.ID] = &transfer{
+		offer:      offer,
+		sender:     sender,
+		recipients: recipients,
+		created:    time.Now(),
+	}
+	s.transfersMutex.Unlock()
+
+	s.logs <- fmt.Sprintf("%s %v offers %v (%d bytes) to %v",
+		time.Now().Format("15:04"), sender.Name, offer.Name, offer.Size, offer.To)
+	for _, recipient := range recipients {
+		recipient.send(offer)
+	}
+}
+
+func (s *TcpChatServer) acceptFile(recipient *client, accept protocol.FileAcceptCommand) {
+	s.transfersMutex.Lock()
+	t, ok := s.transfers[accept.ID]
+	offered := ok && containsClient(t.recipients, recipient)
+	if offered && !containsClient(t.accepted, recipient) {
+		t.accepted = append(t.accepted, recipient)
+	}
+	s.transfersMutex.Unlock()
+	if !offered {
+		recipient.writeError(protocol.CodeBadRequest, fmt.Sprintf("no such file offer: %v", accept.ID))
+		return
+	}
+	t.sender.send(protocol.FileAcceptCommand{
+		ID:   accept.ID,
+		From: recipient.Name,
+	})
+}
+
+func (s *TcpChatServer) relayChunk(sender *client, chunk protocol.FileChunkCommand) {
+	s.transfersMutex.Lock()
+	t, ok := s.transfers[chunk.ID]
+	var recipients []*client
+	if ok {
+		s.mutex.Lock()
+		for _, recipient := range t.accepted {
+			if recipient.Name == chunk.To {
+				recipients = append(recipients, recipient)
+			}
+		}
+		s.mutex.Unlock()
+	}
+	s.transfersMutex.Unlock()
+	if !ok || t.sender != sender {
+		sender.writeError(protocol.CodeNotPermitted, fmt.Sprintf("no such file offer: %v", chunk.ID))
+		return
+	}
+	if chunk.Offset > t.offer.Size || int64(len(chunk.Data)) > t.offer.Size-chunk.Offset {
+		sender.writeError(protocol.CodeBadRequest, "chunk exceeds offered file size")
+		return
+	}
+	for _, recipient := range recipients {
+		recipient.sendWait(chunk, s.writeTimeout)
+	}
+}
+
+func (s *TcpChatServer) dropTransfers(sender *client) {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+	for id, t := range s.transfers {
+		if t.sender == sender {
+			delete(s.transfers, id)
+		}
+	}
+}
+
+func containsClient(clients []*client, client *client) bool {
+	for _, check := range clients {
+		if check == client {
+			return true
+		}
+	}
+	return false
+}
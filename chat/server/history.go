@@ -0,0 +1,55 @@
+package server
+
+import (
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// DefaultHistorySize is how many recent messages of their room clients get
+// replayed once they have a name.
+const DefaultHistorySize = 50
+
+// historyBudget keeps HISTORY well below the frame size clients accept by
+// default, quoting may double the size of a message.
+const historyBudget = protocol.DefaultMaxFrameSize / 2
+
+// SetHistorySize sets how many messages are replayed, zero disables the
+// replay. The backlog is taken from the messages kept for editing, so it
+// never exceeds DefaultMessageLogSize.
+func (s *TcpChatServer) SetHistorySize(size int) {
+	s.historySize = size
+}
+
+// recent returns up to n of the newest messages posted to room that fit
+// into budget bytes, oldest first and with edits applied.
+func (l *messageLog) recent(room string, n, budget int) []protocol.MessageCommand {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var messages []protocol.MessageCommand
+	for i := len(l.messages) - 1; i >= 0 && len(messages) < n; i-- {
+		message := l.messages[i]
+		if message.Room != room || message.Deleted {
+			continue
+		}
+		// Room for the id and timestamp fields.
+		if budget -= len(message.Name) + len(message.Message) + 64; budget < 0 {
+			break
+		}
+		messages = append(messages, message.MessageCommand)
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// replayHistory sends the backlog of the client's room once the client got
+// its first name, either by NAME or by logging in.
+func (s *TcpChatServer) replayHistory(client *client) {
+	if s.historySize <= 0 || !client.Supports(protocol.FeatureHistory) {
+		return
+	}
+	client.send(protocol.HistoryCommand{
+		Room:     client.Room,
+		Messages: s.messages.recent(client.Room, s.historySize, historyBudget),
+	})
+}
@@ -0,0 +1,631 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// The IRC gateway speaks the part of RFC 1459/2812 needed to chat: NICK,
+// USER, JOIN, PART, PRIVMSG, NAMES, PING and QUIT. Every IRC connection is
+// bridged to an ordinary chat client over a pipe, so IRC users share rooms,
+// user lists and broadcasts with everybody else. Chat rooms are IRC
+// channels, a client is in one room at a time.
+const (
+	ircServerName    = "chat"
+	ircMaxLineLength = 512
+)
+
+// ListenIRC accepts IRC clients on address, accepting the same addresses
+// as Listen.
+func (s *TcpChatServer) ListenIRC(address string) error {
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		tlsListener, err := s.listenTLS(l, address)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tlsListener
+	}
+	s.AddIRCListener(l)
+	return nil
+}
+
+// AddIRCListener serves IRC clients accepted from l, it must be called
+// before Start.
+func (s *TcpChatServer) AddIRCListener(l net.Listener) {
+	s.ircListeners = append(s.ircListeners, l)
+	s.logs <- fmt.Sprintf("%s Serving IRC on %v",
+		time.Now().Format("15:04"), l.Addr())
+}
+
+type ircMessage struct {
+	command string
+	params  []string
+}
+
+func parseIRC(line string) ircMessage {
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = line[i+1:]
+		} else {
+			line = ""
+		}
+	}
+	var msg ircMessage
+	for line != "" {
+		if strings.HasPrefix(line, ":") && msg.command != "" {
+			msg.params = append(msg.params, line[1:])
+			break
+		}
+		var word string
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			word, line = line[:i], strings.TrimLeft(line[i+1:], " ")
+		} else {
+			word, line = line, ""
+		}
+		if msg.command == "" {
+			msg.command = strings.ToUpper(word)
+		} else {
+			msg.params = append(msg.params, word)
+		}
+	}
+	return msg
+}
+
+// ircNick shows chat names, which may contain spaces, as IRC nicks.
+func ircNick(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
+
+func ircChannel(room string) string {
+	return "#" + room
+}
+
+type ircSession struct {
+	server *TcpChatServer
+	conn   net.Conn
+	addr   string
+	chat   net.Conn
+	reader *protocol.CommandReader
+	writer *protocol.CommandWriter
+
+	writeMutex *sync.Mutex
+
+	// Guarded by mutex, shared by the IRC and chat sides.
+	mutex       *sync.Mutex
+	nick        string
+	pendingNick string
+	user        string
+	welcomed    bool
+	room        string
+	users       []string
+	acked       map[uint64]bool
+}
+
+func (s *TcpChatServer) serveIRC(conn net.Conn) {
+	session := &ircSession{
+		server:     s,
+		conn:       conn,
+		addr:       conn.RemoteAddr().String(),
+		writeMutex: &sync.Mutex{},
+		mutex:      &sync.Mutex{},
+		room:       protocol.LobbyRoom,
+		acked:      make(map[uint64]bool),
+	}
+	s.logs <- fmt.Sprintf("%s IRC connection from %v",
+		time.Now().Format("15:04"), session.addr)
+	s.track(conn, session.windDown)
+	defer session.close()
+	if s.closing() {
+		// Accepted while Shutdown was collecting the connections.
+		session.windDown()
+	}
+	go session.keepalive()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, ircMaxLineLength), s.maxFrameSize)
+	for {
+		session.setReadDeadline()
+		if !scanner.Scan() {
+			break
+		}
+		msg := parseIRC(scanner.Text())
+		if msg.command == "" {
+			continue
+		}
+		if !session.handle(msg) {
+			break
+		}
+	}
+}
+
+func (c *ircSession) setReadDeadline() {
+	if c.server.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.server.idleTimeout))
+	}
+}
+
+// keepalive pings the IRC client so dead connections hit the idle timeout,
+// the chat side of the pipe answers the server's pings itself.
+func (c *ircSession) keepalive() {
+	if c.server.pingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.server.pingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.send("PING :%s", ircServerName); err != nil {
+			return
+		}
+	}
+}
+
+// windDown closes sessions not bridged yet, bridged ones close once the
+// server drops their chat client.
+func (c *ircSession) windDown() {
+	c.mutex.Lock()
+	bridged := c.writer != nil
+	c.mutex.Unlock()
+	if !bridged {
+		c.send("ERROR :Closing link: server is shutting down")
+		c.conn.Close()
+	}
+}
+
+func (c *ircSession) close() {
+	c.conn.Close()
+	if c.chat != nil {
+		c.chat.Close()
+	}
+	c.server.untrack(c.conn)
+	c.server.logs <- fmt.Sprintf("%s IRC connection from %v closed",
+		time.Now().Format("15:04"), c.addr)
+}
+
+func (c *ircSession) send(format string, args ...interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := fmt.Fprintf(c.conn, format+"\r\n", args...)
+	return err
+}
+
+// reply sends a numeric reply addressed to the client's nick.
+func (c *ircSession) reply(numeric int, params string) error {
+	c.mutex.Lock()
+	nick := c.nick
+	c.mutex.Unlock()
+	if nick == "" {
+		nick = "*"
+	}
+	return c.send(":%s %03d %s %s", ircServerName, numeric, ircNick(nick), params)
+}
+
+func (c *ircSession) prefix(name string) string {
+	nick := ircNick(name)
+	return fmt.Sprintf("%s!%s@%s", nick, nick, ircServerName)
+}
+
+func (c *ircSession) handle(msg ircMessage) bool {
+	switch msg.command {
+	case "CAP":
+		// Capability negotiation is not supported, clients register
+		// without it.
+	case "PING":
+		c.send(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(msg.params, " "))
+	case "PONG":
+	case "QUIT":
+		return false
+	case "NICK":
+		c.setNick(msg)
+	case "USER":
+		if len(msg.params) < 4 {
+			c.reply(461, "USER :Not enough parameters")
+			break
+		}
+		c.mutex.Lock()
+		registered := c.user != ""
+		c.user = msg.params[0]
+		c.mutex.Unlock()
+		if registered {
+			c.reply(462, ":You may not reregister")
+			break
+		}
+		c.register()
+	default:
+		c.mutex.Lock()
+		welcomed := c.welcomed
+		c.mutex.Unlock()
+		if !welcomed {
+			c.reply(451, ":You have not registered")
+			break
+		}
+		c.handleRegistered(msg)
+	}
+	return true
+}
+
+func (c *ircSession) handleRegistered(msg ircMessage) {
+	switch msg.command {
+	case "JOIN":
+		if len(msg.params) == 0 {
+			c.reply(461, "JOIN :Not enough parameters")
+			return
+		}
+		// Only one room at a time, the last channel listed wins.
+		channels := strings.Split(msg.params[0], ",")
+		channel := channels[len(channels)-1]
+		if !strings.HasPrefix(channel, "#") {
+			c.reply(403, channel+" :No such channel")
+			return
+		}
+		c.writer.Write(protocol.JoinCommand{Room: strings.TrimPrefix(channel, "#")})
+	case "PART":
+		c.mutex.Lock()
+		room := c.room
+		c.mutex.Unlock()
+		if len(msg.params) > 0 && msg.params[0] != ircChannel(room) {
+			c.reply(442, msg.params[0]+" :You're not on that channel")
+			return
+		}
+		c.writer.Write(protocol.PartCommand{Room: room})
+	case "PRIVMSG", "NOTICE":
+		if len(msg.params) == 0 {
+			c.reply(411, ":No recipient given ("+msg.command+")")
+			return
+		}
+		if len(msg.params) < 2 || msg.params[1] == "" {
+			c.reply(412, ":No text to send")
+			return
+		}
+		c.privmsg(msg.params[0], msg.params[1])
+	case "NAMES":
+		c.mutex.Lock()
+		room := c.room
+		c.mutex.Unlock()
+		if len(msg.params) > 0 && msg.params[0] != ircChannel(room) {
+			c.reply(366, msg.params[0]+" :End of /NAMES list")
+			return
+		}
+		c.names()
+	default:
+		c.reply(421, msg.command+" :Unknown command")
+	}
+}
+
+func (c *ircSession) setNick(msg ircMessage) {
+	if len(msg.params) == 0 || msg.params[0] == "" {
+		c.reply(431, ":No nickname given")
+		return
+	}
+	nick := msg.params[0]
+	if err := protocol.ValidName(nick); err != nil {
+		c.reply(432, nick+" :Erroneous nickname")
+		return
+	}
+	c.mutex.Lock()
+	c.pendingNick = nick
+	connected := c.writer != nil
+	c.mutex.Unlock()
+	if connected {
+		c.writer.Write(protocol.NameCommand{Name: nick})
+	} else {
+		c.register()
+	}
+}
+
+// register bridges the session to the chat server once both NICK and USER
+// were received.
+func (c *ircSession) register() {
+	c.mutex.Lock()
+	ready := c.pendingNick != "" && c.user != "" && c.writer == nil
+	nick := c.pendingNick
+	c.mutex.Unlock()
+	if !ready {
+		return
+	}
+	client, gateway := net.Pipe()
+	c.server.serveGateway(client, gatewayAddr{"irc", c.addr})
+	reader := protocol.NewCommandReader(gateway)
+	writer := protocol.NewCommandWriter(gateway)
+	err := writer.Write(protocol.HelloCommand{
+		Version:  protocol.Version,
+		Features: []string{protocol.FeatureWhisper, protocol.FeatureRooms, protocol.FeaturePing, protocol.FeatureNick},
+	})
+	if err == nil {
+		err = awaitWelcome(reader)
+	}
+	if err != nil {
+		gateway.Close()
+		c.send("ERROR :Closing link: %v", err)
+		return
+	}
+	c.mutex.Lock()
+	c.chat = gateway
+	c.reader = reader
+	c.writer = writer
+	c.mutex.Unlock()
+	go c.relay()
+	writer.Write(protocol.NameCommand{Name: nick})
+}
+
+// awaitWelcome skips whatever was broadcast to the lobby before the
+// server answered HELLO.
+func awaitWelcome(reader *protocol.CommandReader) error {
+	for {
+		cmd, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		switch v := cmd.(type) {
+		case protocol.WelcomeCommand:
+			return nil
+		case protocol.RejectCommand:
+			return fmt.Errorf("rejected by server: %v", v.Reason)
+		}
+	}
+}
+
+// serveGateway runs conn as a chat client whose peer is a gateway.
+func (s *TcpChatServer) serveGateway(conn net.Conn, addr gatewayAddr) {
+	go s.serve(s.accept(&gatewayConn{Conn: conn, remote: addr}))
+}
+
+type gatewayConn struct {
+	net.Conn
+	remote gatewayAddr
+}
+
+func (c *gatewayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *ircSession) privmsg(target, text string) {
+	c.mutex.Lock()
+	room := c.room
+	users := c.users
+	c.mutex.Unlock()
+	if strings.HasPrefix(target, "#") {
+		if target != ircChannel(room) {
+			c.reply(404, target+" :Cannot send to channel")
+			return
+		}
+		c.writer.Write(protocol.SendCommand{Message: text})
+		return
+	}
+	// Nicks stand for names with spaces, map them back if we know whom.
+	for _, name := range users {
+		if ircNick(name) == target {
+			target = name
+			break
+		}
+	}
+	c.writer.Write(protocol.WhisperCommand{To: target, Message: text})
+}
+
+func (c *ircSession) names() {
+	c.mutex.Lock()
+	room := c.room
+	nicks := make([]string, len(c.users))
+	for i, name := range c.users {
+		nicks[i] = ircNick(name)
+	}
+	c.mutex.Unlock()
+	c.reply(353, fmt.Sprintf("= %s :%s", ircChannel(room), strings.Join(nicks, " ")))
+	c.reply(366, ircChannel(room)+" :End of /NAMES list")
+}
+
+// relay turns commands from the chat server into IRC messages until the
+// server drops the client.
+func (c *ircSession) relay() {
+	defer c.conn.Close()
+	for {
+		cmd, err := c.reader.Read()
+		if err != nil {
+			if _, recoverable := protocol.ErrorFor(err); recoverable {
+				continue
+			}
+			c.send("ERROR :Closing link: %v", err)
+			return
+		}
+		switch v := cmd.(type) {
+		case protocol.AckCommand:
+			c.mutex.Lock()
+			c.acked[v.ID] = true
+			c.mutex.Unlock()
+		case protocol.MessageCommand:
+			c.mutex.Lock()
+			own := c.acked[v.ID]
+			delete(c.acked, v.ID)
+			room := c.room
+			c.mutex.Unlock()
+			if own {
+				// IRC clients show their own messages already.
+				break
+			}
+			c.sendText(c.prefix(v.Name), ircChannel(room), v.Message)
+		case protocol.PrivateMessageCommand:
+			c.mutex.Lock()
+			nick := c.nick
+			c.mutex.Unlock()
+			if v.From == nick && v.To != nick {
+				break
+			}
+			c.sendText(c.prefix(v.From), ircNick(nick), v.Message)
+		case protocol.UsersCommand:
+			c.updateUsers(v.Users)
+		case protocol.RenameCommand:
+			c.rename(v)
+		case protocol.JoinCommand:
+			c.mutex.Lock()
+			previous := c.room
+			c.room = v.Room
+			c.users = nil
+			nick := c.nick
+			c.mutex.Unlock()
+			c.send(":%s PART %s", c.prefix(nick), ircChannel(previous))
+			c.send(":%s JOIN %s", c.prefix(nick), ircChannel(v.Room))
+		case protocol.ErrorCommand:
+			if v.Code == protocol.CodeShuttingDown {
+				c.send("ERROR :Closing link: %s", ircText(v.Message))
+				return
+			}
+			c.error(v)
+		case protocol.PingCommand:
+			c.writer.Write(protocol.PongCommand{Token: v.Token})
+		case protocol.RejectCommand:
+			c.send("ERROR :Closing link: %s", ircText(v.Reason))
+			return
+		}
+	}
+}
+
+// sendText splits multi-line chat messages into one PRIVMSG per line, a
+// bare "\r" ends a line as well. IRC has no empty messages, blank lines are
+// dropped.
+func (c *ircSession) sendText(prefix, target, text string) {
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	}) {
+		if line = ircText(line); line != "" {
+			c.send(":%s PRIVMSG %s :%s", prefix, target, line)
+		}
+	}
+}
+
+// ircText makes chat text safe to put at the end of an IRC line, line
+// breaks would let it add lines of its own and other control characters
+// are dropped, formatting codes included.
+func ircText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r' || r == '\n':
+			return ' '
+		case r != '\t' && unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func (c *ircSession) error(e protocol.ErrorCommand) {
+	switch e.Code {
+	case protocol.CodeInvalidName, protocol.CodeNameTaken:
+		c.mutex.Lock()
+		nick := c.pendingNick
+		c.pendingNick = ""
+		c.mutex.Unlock()
+		numeric := 432
+		if e.Code == protocol.CodeNameTaken {
+			numeric = 433
+		}
+		c.reply(numeric, nick+" :"+ircText(e.Message))
+	case protocol.CodeNoSuchUser:
+		c.reply(401, ":"+ircText(e.Message))
+	default:
+		c.mutex.Lock()
+		nick := c.nick
+		c.mutex.Unlock()
+		if nick == "" {
+			nick = "*"
+		}
+		c.send(":%s NOTICE %s :%s: %s", ircServerName, ircNick(nick), ircText(e.Code), ircText(e.Message))
+	}
+}
+
+// rename completes a NICK, the server confirms the first one with an empty
+// From, and turns renames in the channel into NICK messages.
+func (c *ircSession) rename(rename protocol.RenameCommand) {
+	c.mutex.Lock()
+	if rename.From == "" || rename.From == c.nick {
+		c.nick = rename.To
+		c.pendingNick = ""
+	}
+	// The user list is shared with readers holding no lock, so it is
+	// replaced rather than changed in place.
+	users := make([]string, len(c.users))
+	for i, name := range c.users {
+		if name == rename.From {
+			name = rename.To
+		}
+		users[i] = name
+	}
+	c.users = users
+	welcomed := c.welcomed
+	c.mutex.Unlock()
+	if welcomed {
+		c.send(":%s NICK :%s", c.prefix(rename.From), ircNick(rename.To))
+	}
+}
+
+// updateUsers welcomes the client once its first nick was confirmed and
+// reports everybody else arriving or leaving as JOIN and PART.
+func (c *ircSession) updateUsers(users []protocol.UserInfo) {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Name
+	}
+	c.mutex.Lock()
+	previous := c.users
+	c.users = names
+	room := c.room
+	nick := c.nick
+	welcome := nick != "" && !c.welcomed
+	welcomed := c.welcomed
+	if welcome {
+		c.welcomed = true
+	}
+	c.mutex.Unlock()
+
+	if welcome {
+		c.welcome(nick)
+		c.send(":%s JOIN %s", c.prefix(nick), ircChannel(room))
+		c.names()
+		return
+	}
+	if !welcomed {
+		return
+	}
+	if previous == nil {
+		c.names()
+		return
+	}
+	for _, name := range names {
+		if name != nick && !containsName(previous, name) {
+			c.send(":%s JOIN %s", c.prefix(name), ircChannel(room))
+		}
+	}
+	for _, name := range previous {
+		if name != nick && !containsName(names, name) {
+			c.send(":%s PART %s", c.prefix(name), ircChannel(room))
+		}
+	}
+}
+
+func (c *ircSession) welcome(nick string) {
+	c.reply(1, ":Welcome to the chat "+ircNick(nick))
+	c.reply(2, ":Your host is "+ircServerName+", protocol version "+strconv.Itoa(protocol.Version))
+	c.reply(3, ":This server bridges IRC into the chat")
+	c.reply(4, ircServerName+" chat-"+strconv.Itoa(protocol.Version)+" o o")
+	c.reply(422, ":MOTD File is missing")
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// TestIRCTextInjection sends chat messages carrying IRC lines to an IRC
+// client, which must get them as text of the PRIVMSGs only.
+func TestIRCTextInjection(t *testing.T) {
+	var ircAddr string
+	s := startServer(t, func(s *TcpChatServer) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ircAddr = l.Addr().String()
+		s.AddIRCListener(l)
+	})
+	irc, err := net.Dial("tcp", ircAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer irc.Close()
+	irc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(irc, "NICK carol\r\nUSER carol 0 * :Carol\r\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !contains(s.ClientsUsernames(), "carol") {
+		if time.Now().After(deadline) {
+			t.Fatal("IRC client not named")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c := dial(t, s.addr, protocol.TextCodec)
+	if c == nil {
+		return
+	}
+	defer c.conn.Close()
+	c.write(protocol.NameCommand{Name: "bob"})
+	c.write(protocol.SendCommand{Message: "hi\r:evil!x@chat PRIVMSG #lobby :owned"})
+	c.write(protocol.WhisperCommand{To: "carol", Message: "psst\r:chat 001 carol :fake\x01"})
+	c.write(protocol.SendCommand{Message: "done"})
+
+	lines := bufio.NewScanner(irc)
+	var got []string
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, ":bob!bob@chat PRIVMSG ") {
+			got = append(got, line)
+		}
+		if strings.HasSuffix(line, ":done") {
+			break
+		}
+		if !strings.HasPrefix(line, ":chat ") && !strings.HasPrefix(line, ":carol!") &&
+			!strings.HasPrefix(line, ":bob!") && !strings.HasPrefix(line, "PING") {
+			t.Errorf("injected line %q", line)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		":bob!bob@chat PRIVMSG #lobby :hi",
+		":bob!bob@chat PRIVMSG #lobby ::evil!x@chat PRIVMSG #lobby :owned",
+		":bob!bob@chat PRIVMSG carol :psst",
+		":bob!bob@chat PRIVMSG carol ::chat 001 carol :fake",
+		":bob!bob@chat PRIVMSG #lobby :done",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
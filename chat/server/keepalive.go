@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultIdleTimeout  = 90 * time.Second
+)
+
+func (s *TcpChatServer) SetPingInterval(interval time.Duration) {
+	s.pingInterval = interval
+}
+
+// SetIdleTimeout sets how long a client supporting PING may stay silent
+// before it is disconnected, zero disables eviction.
+func (s *TcpChatServer) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+func (s *TcpChatServer) heartbeat(client *client) {
+	if s.pingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.done:
+			return
+		case now := <-ticker.C:
+			token := strconv.FormatInt(now.UnixNano(), 10)
+			client.send(protocol.PingCommand{Token: token})
+		}
+	}
+}
+
+func (s *TcpChatServer) pong(client *client, pong protocol.PongCommand) {
+	sent, err := strconv.ParseInt(pong.Token, 10, 64)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	client.Latency = time.Since(time.Unix(0, sent))
+	s.mutex.Unlock()
+}
+
+// Clients are expected to greet the server within the idle timeout, after
+// that the deadline only applies to clients answering pings. During
+// shutdown reads fail right away so serve lets go of the client.
+func (s *TcpChatServer) setReadDeadline(client *client) {
+	if s.closing() {
+		client.Conn.SetReadDeadline(time.Now())
+	} else if s.idleTimeout > 0 && (!client.greeted || client.Supports(protocol.FeaturePing)) {
+		client.Conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	} else {
+		client.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (s *TcpChatServer) logEvicted(client *client) {
+	s.logs <- fmt.Sprintf("%s Evicting %v [%v]: idle for %v",
+		time.Now().Format("15:04"), client.Name, client.Addr, s.idleTimeout)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const (
+	DefaultShutdownTimeout = 5 * time.Second
+	shutdownPollInterval   = 50 * time.Millisecond
+	maxAcceptDelay         = time.Second
+)
+
+// ErrServerClosed is returned by Start after Shutdown or Close.
+var ErrServerClosed = errors.New("chat server closed")
+
+// Start serves every listener until ctx is cancelled, Shutdown or Close is
+// called or a listener fails. A cancelled ctx shuts the server down within
+// DefaultShutdownTimeout. Start fails right away if the transcript can not
+// be opened.
+func (s *TcpChatServer) Start(ctx context.Context) error {
+	if err := s.openTranscript(); err != nil {
+		s.Close()
+		return err
+	}
+	go s.watchPresence()
+	errs := make(chan error, len(s.listeners)+len(s.ircListeners)+len(s.httpListeners))
+	wg := &sync.WaitGroup{}
+	serve := func(l net.Listener, run func(net.Listener) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(l); err != nil && !s.closing() {
+				errs <- err
+			}
+		}()
+	}
+	for _, l := range s.listeners {
+		serve(l, func(l net.Listener) error {
+			return s.acceptLoop(l, func(conn net.Conn) {
+				s.serve(s.accept(conn))
+			})
+		})
+	}
+	for _, l := range s.ircListeners {
+		serve(l, func(l net.Listener) error {
+			return s.acceptLoop(l, s.serveIRC)
+		})
+	}
+	handler := s.httpHandler()
+	for _, l := range s.httpListeners {
+		serve(l, func(l net.Listener) error {
+			return http.Serve(l, handler)
+		})
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+		return ctx.Err()
+	case err := <-errs:
+		s.Close()
+		return err
+	case <-stopped:
+		return ErrServerClosed
+	}
+}
+
+func (s *TcpChatServer) acceptLoop(l net.Listener, serve func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing() {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				// Out of file descriptors and the like, retry later
+				// rather than spinning.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Printf("Accept error: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go serve(conn)
+	}
+}
+
+func (s *TcpChatServer) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *TcpChatServer) stopAccepting() error {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+	var err error
+	for _, listeners := range [][]net.Listener{s.listeners, s.httpListeners, s.ircListeners} {
+		for _, l := range listeners {
+			if closeErr := l.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// track registers an open connection together with a function asking it to
+// wind down on Shutdown, untrack forgets it once closed.
+func (s *TcpChatServer) track(conn net.Conn, windDown func()) {
+	s.mutex.Lock()
+	s.conns[conn] = windDown
+	s.mutex.Unlock()
+}
+
+func (s *TcpChatServer) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+}
+
+// Shutdown stops accepting connections, tells every client the server is
+// going away and waits for their queues to be flushed. Connections still
+// open when ctx is done are closed and ctx's error is returned.
+func (s *TcpChatServer) Shutdown(ctx context.Context) error {
+	err := s.stopAccepting()
+	s.mutex.Lock()
+	windDowns := make([]func(), 0, len(s.conns))
+	for _, windDown := range s.conns {
+		windDowns = append(windDowns, windDown)
+	}
+	s.mutex.Unlock()
+	s.logs <- fmt.Sprintf("%s Shutting down, closing %d connections",
+		time.Now().Format("15:04"), len(windDowns))
+	for _, windDown := range windDowns {
+		windDown()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mutex.Lock()
+		open := len(s.conns)
+		s.mutex.Unlock()
+		if open == 0 {
+			s.closeTranscript()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConnections()
+			s.closeTranscript()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// windDown queues the shutdown notice and wakes serve up, also from a
+// throttling pause, which removes the client, after that its writer flushes
+// the queue and closes the connection.
+func (s *TcpChatServer) windDown(client *client) {
+	s.mutex.Lock()
+	greeted := client.greeted
+	s.mutex.Unlock()
+	if greeted {
+		client.send(protocol.ErrorCommand{
+			Code:    protocol.CodeShuttingDown,
+			Message: "server is shutting down",
+		})
+	}
+	client.Conn.SetReadDeadline(time.Now())
+	client.windDownOnce.Do(func() {
+		close(client.windingDown)
+	})
+}
+
+// Close closes every listener and connection at once, Shutdown lets
+// clients know first.
+func (s *TcpChatServer) Close() error {
+	err := s.stopAccepting()
+	s.closeConnections()
+	s.closeTranscript()
+	return err
+}
+
+func (s *TcpChatServer) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
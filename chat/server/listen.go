@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// UnixScheme prefixes addresses of unix domain sockets.
+const UnixScheme = "unix://"
+
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, UnixScheme) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, UnixScheme)
+	removeStaleSocket(path)
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket deletes a socket file left behind by a server that did
+// not shut down cleanly, a socket somebody still listens on is kept.
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// remoteAddr names the peer of conn for logs and as the default user name,
+// unix socket peers are unnamed so they are numbered instead.
+func (s *TcpChatServer) remoteAddr(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if addr != "" && addr != "@" {
+		return addr
+	}
+	return fmt.Sprintf("%v#%d", conn.LocalAddr(), atomic.AddUint64(&s.lastConn, 1))
+}
+
+// gatewayAddr is the peer address of a client connected through a gateway,
+// prefixed with the gateway's scheme so logs tell them apart.
+type gatewayAddr struct {
+	scheme string
+	addr   string
+}
+
+func (a gatewayAddr) Network() string {
+	return a.scheme
+}
+
+func (a gatewayAddr) String() string {
+	return a.scheme + "://" + a.addr
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const DefaultMessageLogSize = 1000
+
+var errMessageNotFound = errors.New("no such message or it is too old")
+
+type storedMessage struct {
+	protocol.MessageCommand
+	Room string
+	// Author is who may change the message, see client.author. Messages
+	// loaded from the transcript have none and only operators may change
+	// them.
+	Author  string
+	Deleted bool
+}
+
+// messageLog keeps the most recent messages ordered by id, so they can be
+// edited or deleted by their authors.
+type messageLog struct {
+	mutex    *sync.Mutex
+	messages []*storedMessage
+	size     int
+}
+
+func newMessageLog(size int) *messageLog {
+	return &messageLog{
+		mutex: &sync.Mutex{},
+		size:  size,
+	}
+}
+
+func (l *messageLog) add(room, author string, message protocol.MessageCommand) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, &storedMessage{
+		MessageCommand: message,
+		Room:           room,
+		Author:         author,
+	})
+	if extra := len(l.messages) - l.size; extra > 0 {
+		l.messages = append(l.messages[:0:0], l.messages[extra:]...)
+	}
+}
+
+// sendMessage gives a message sent by client the next id, stores it and
+// sends it to the room.
+func (s *TcpChatServer) sendMessage(client *client, text string) {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	s.lastID++
+	message := protocol.MessageCommand{
+		ID:      s.lastID,
+		Time:    time.Now(),
+		Message: text,
+		Name:    client.Name,
+	}
+	s.messages.add(client.Room, client.author(), message)
+	s.recordMessage(client.Room, message)
+	if client.Version >= protocol.MessageIDVersion {
+		client.send(protocol.AckCommand{
+			ID:   message.ID,
+			Time: message.Time,
+		})
+	}
+	s.BroadcastRoom(client.Room, message)
+}
+
+// update calls change on the message under the log lock and returns a copy
+// of the result.
+func (l *messageLog) update(id uint64, change func(message *storedMessage) error) (storedMessage, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	i := sort.Search(len(l.messages), func(i int) bool {
+		return l.messages[i].ID >= id
+	})
+	if i == len(l.messages) || l.messages[i].ID != id || l.messages[i].Deleted {
+		return storedMessage{}, errMessageNotFound
+	}
+	if err := change(l.messages[i]); err != nil {
+		return storedMessage{}, err
+	}
+	return *l.messages[i], nil
+}
+
+// SetOperators sets the accounts allowed to edit and delete any message,
+// operators have to log in with AUTH.
+func (s *TcpChatServer) SetOperators(accounts ...string) {
+	s.operators = accounts
+}
+
+func (s *TcpChatServer) isOperator(client *client) bool {
+	if client.Account == "" {
+		return false
+	}
+	for _, account := range s.operators {
+		if accountKey(account) == accountKey(client.Account) {
+			return true
+		}
+	}
+	return false
+}
+
+// author identifies the sender of a message for edits and deletes. Names
+// are released on disconnect and can be changed, so logged in clients are
+// identified by their account and guests by their connection.
+func (c *client) author() string {
+	if c.Account != "" {
+		return "account:" + accountKey(c.Account)
+	}
+	return "conn:" + strconv.FormatUint(c.connID, 10)
+}
+
+func (s *TcpChatServer) editMessage(client *client, edit protocol.EditCommand) {
+	message, err := s.messages.update(edit.ID, func(message *storedMessage) error {
+		if err := s.checkAuthor(client, message); err != nil {
+			return err
+		}
+		message.Message = edit.Message
+		return nil
+	})
+	if err != nil {
+		s.replyEditError(client, err)
+		return
+	}
+	s.logs <- fmt.Sprintf("%s %v edited message #%d",
+		time.Now().Format("15:04"), client.Name, edit.ID)
+	s.record(record{
+		kind:    recordEdit,
+		id:      edit.ID,
+		room:    message.Room,
+		message: edit.Message,
+	})
+	s.broadcastFeature(message.Room, protocol.FeatureEdit, edit)
+}
+
+func (s *TcpChatServer) deleteMessage(client *client, del protocol.DeleteCommand) {
+	message, err := s.messages.update(del.ID, func(message *storedMessage) error {
+		if err := s.checkAuthor(client, message); err != nil {
+			return err
+		}
+		message.Deleted = true
+		return nil
+	})
+	if err != nil {
+		s.replyEditError(client, err)
+		return
+	}
+	s.logs <- fmt.Sprintf("%s %v deleted message #%d",
+		time.Now().Format("15:04"), client.Name, del.ID)
+	s.record(record{
+		kind: recordDelete,
+		id:   del.ID,
+		room: message.Room,
+	})
+	s.broadcastFeature(message.Room, protocol.FeatureEdit, del)
+}
+
+var errNotAuthor = errors.New("only the author or an operator may change this message")
+
+func (s *TcpChatServer) checkAuthor(client *client, message *storedMessage) error {
+	if (message.Author == "" || message.Author != client.author()) && !s.isOperator(client) {
+		return errNotAuthor
+	}
+	return nil
+}
+
+func (s *TcpChatServer) replyEditError(client *client, err error) {
+	code := protocol.CodeBadRequest
+	if err == errNotAuthor {
+		code = protocol.CodeNotPermitted
+	}
+	client.writeError(code, err.Error())
+}
+
+// broadcastFeature sends the command to the room members that negotiated
+// the feature, others would not understand it.
+func (s *TcpChatServer) broadcastFeature(room, feature string, command protocol.Command) {
+	for _, client := range s.roomClients(room) {
+		if client.Supports(feature) {
+			client.send(command)
+		}
+	}
+}
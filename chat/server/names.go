@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+var errNameInUse = errors.New("name is already in use")
+
+func (s *TcpChatServer) setName(client *client, name string) {
+	if err := protocol.ValidName(name); err != nil {
+		client.writeError(protocol.CodeInvalidName, err.Error())
+		return
+	}
+	if err := s.checkReserved(client, name); err == errNameReserved {
+		client.writeError(protocol.CodeNameTaken, err.Error())
+		return
+	} else if err != nil {
+		client.writeError(protocol.CodeInternal, "user store is unavailable")
+		return
+	}
+	old, named, err := s.claimName(client, name)
+	if err != nil {
+		client.writeError(protocol.CodeNameTaken, err.Error())
+		return
+	}
+	if !named && client.Supports(protocol.FeatureNick) {
+		client.send(protocol.RenameCommand{To: name})
+	}
+	s.renamed(client, old, named)
+}
+
+// nameInUse tells whether another connected client goes by name, names
+// differing only in case count as the same. The caller holds s.mutex.
+func (s *TcpChatServer) nameInUse(client *client, name string) bool {
+	for _, other := range s.clients {
+		if other != client && other.named && accountKey(other.Name) == accountKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimName gives name to the client unless somebody else uses it, it
+// returns the previous name and whether the client had chosen one.
+func (s *TcpChatServer) claimName(client *client, name string) (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nameInUse(client, name) {
+		return "", false, errNameInUse
+	}
+	old, named := client.Name, client.named
+	client.Name = name
+	client.named = true
+	return old, named, nil
+}
+
+// renamed lets the room know about a new name, a client getting its first
+// name is greeted with the room's history instead.
+func (s *TcpChatServer) renamed(client *client, old string, named bool) {
+	s.mutex.Lock()
+	name := client.Name
+	s.mutex.Unlock()
+	if named && old != name {
+		s.logs <- fmt.Sprintf("%s %v is now known as %v",
+			time.Now().Format("15:04"), old, name)
+		s.broadcastFeature(client.Room, protocol.FeatureNick, protocol.RenameCommand{
+			From: old,
+			To:   name,
+		})
+	}
+	s.notifyClients()
+	s.updateUsers(client.Room)
+	if !named {
+		s.replayHistory(client)
+	}
+}
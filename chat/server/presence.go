@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const DefaultAutoAway = 10 * time.Minute
+
+// SetAutoAway sets after how long without activity online clients are
+// marked away, zero disables it.
+func (s *TcpChatServer) SetAutoAway(timeout time.Duration) {
+	s.autoAway = timeout
+}
+
+func (s *TcpChatServer) RoomUsers(room string) []protocol.UserInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var users []protocol.UserInfo
+	for _, client := range s.clients {
+		if client.Room == room {
+			users = append(users, client.userInfo())
+		}
+	}
+	return users
+}
+
+func (c *client) userInfo() protocol.UserInfo {
+	return protocol.UserInfo{
+		Name:   c.Name,
+		Status: c.Status,
+		Text:   c.StatusText,
+	}
+}
+
+func (s *TcpChatServer) setStatus(client *client, status protocol.StatusCommand) {
+	if err := protocol.ValidStatus(status.Status, status.Text); err != nil {
+		client.writeError(protocol.CodeBadRequest, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	client.Status = status.Status
+	client.StatusText = status.Text
+	client.autoAway = false
+	info := client.userInfo()
+	s.mutex.Unlock()
+	s.logs <- fmt.Sprintf("%s %v is %v",
+		time.Now().Format("15:04"), client.Name, info)
+	s.updateUsers(client.Room)
+}
+
+// touch records user activity and brings auto-away clients back online.
+func (s *TcpChatServer) touch(client *client) {
+	s.mutex.Lock()
+	client.lastActive = time.Now()
+	back := client.autoAway
+	if back {
+		client.Status = protocol.StatusOnline
+		client.autoAway = false
+	}
+	s.mutex.Unlock()
+	if back {
+		s.updateUsers(client.Room)
+	}
+}
+
+func (s *TcpChatServer) watchPresence() {
+	if s.autoAway <= 0 {
+		return
+	}
+	interval := s.autoAway / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+		rooms := make(map[string]bool)
+		s.mutex.Lock()
+		for _, client := range s.clients {
+			if client.Status == protocol.StatusOnline && time.Since(client.lastActive) > s.autoAway {
+				client.Status = protocol.StatusAway
+				client.autoAway = true
+				rooms[client.Room] = true
+			}
+		}
+		s.mutex.Unlock()
+		for room := range rooms {
+			s.updateUsers(room)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// Every client has a bounded queue of outgoing commands drained by its own
+// writer goroutine, so a client that stops reading only ever stalls itself.
+const (
+	DefaultQueueSize    = 256
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// SlowConsumerPolicy decides what happens to a client whose queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DisconnectSlowConsumers closes the connection of the client.
+	DisconnectSlowConsumers SlowConsumerPolicy = iota
+	// DropForSlowConsumers discards the commands that do not fit.
+	DropForSlowConsumers
+)
+
+var (
+	errClientGone = errors.New("client is disconnected")
+	errQueueFull  = errors.New("send queue is full")
+)
+
+// SetQueueSize sets how many commands may wait for a client, it applies to
+// clients connecting afterwards.
+func (s *TcpChatServer) SetQueueSize(size int) {
+	s.queueSize = size
+}
+
+// SetWriteTimeout limits how long writing a single command may take before
+// the client is disconnected, zero disables the limit.
+func (s *TcpChatServer) SetWriteTimeout(timeout time.Duration) {
+	s.writeTimeout = timeout
+}
+
+func (s *TcpChatServer) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	s.slowConsumers = policy
+}
+
+// send queues the command without blocking.
+func (c *client) send(command protocol.Command) error {
+	select {
+	case <-c.done:
+		return errClientGone
+	default:
+	}
+	select {
+	case c.queue <- command:
+		return nil
+	default:
+	}
+	if c.policy == DropForSlowConsumers {
+		atomic.AddUint64(&c.dropped, 1)
+	} else {
+		c.slowOnce.Do(func() {
+			close(c.slow)
+		})
+	}
+	return errQueueFull
+}
+
+// sendWait is send for bulk data like file chunks, a full queue holds the
+// caller back for up to timeout, which slows the sender down to the pace of
+// the recipient, before counting as a slow consumer.
+func (c *client) sendWait(command protocol.Command, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case c.queue <- command:
+		return nil
+	case <-c.done:
+		return errClientGone
+	case <-expired:
+		return c.send(command)
+	}
+}
+
+// writeLoop writes queued commands until the client is removed, then
+// flushes what is left and closes the connection.
+func (s *TcpChatServer) writeLoop(client *client) {
+	defer close(client.written)
+	defer client.Conn.Close()
+	for {
+		select {
+		case command := <-client.queue:
+			if err := s.write(client, command); err != nil {
+				s.logs <- fmt.Sprintf("%s Write error for %v: %v",
+					time.Now().Format("15:04"), client.Addr, err)
+				return
+			}
+			if dropped := atomic.SwapUint64(&client.dropped, 0); dropped > 0 {
+				s.logs <- fmt.Sprintf("%s Dropped %d commands for slow client %v",
+					time.Now().Format("15:04"), dropped, client.Addr)
+			}
+		case <-client.slow:
+			s.logs <- fmt.Sprintf("%s Disconnecting slow client %v: %d commands queued",
+				time.Now().Format("15:04"), client.Addr, len(client.queue))
+			return
+		case <-client.done:
+			s.flush(client)
+			return
+		}
+	}
+}
+
+func (s *TcpChatServer) flush(client *client) {
+	for {
+		select {
+		case command := <-client.queue:
+			if err := s.write(client, command); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *TcpChatServer) write(client *client, command protocol.Command) error {
+	if s.writeTimeout > 0 {
+		client.Conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	return client.writer.Write(command)
+}
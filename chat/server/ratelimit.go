@@ -0,0 +1,372 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// Commands reaching other users or costing the server work are rate limited
+// with token buckets, one counting commands, one counting the bytes of text
+// and file data they carry and a stricter one counting AUTH and REGISTER,
+// which hash passwords, for every connection and for all connections from
+// one IP address. A bucket holds up to Burst tokens and refills at Rate
+// tokens a second, a command is over the limit when a bucket lacks the
+// tokens it costs.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+var (
+	DefaultMessageLimit   = RateLimit{Rate: 5, Burst: 10}
+	DefaultIPMessageLimit = RateLimit{Rate: 20, Burst: 40}
+	DefaultByteLimit      = RateLimit{Rate: 64 << 10, Burst: 256 << 10}
+	DefaultIPByteLimit    = RateLimit{Rate: 256 << 10, Burst: 1 << 20}
+	DefaultLoginLimit     = RateLimit{Rate: 0.2, Burst: 3}
+	DefaultIPLoginLimit   = RateLimit{Rate: 1, Burst: 10}
+)
+
+const DefaultMuteDuration = 30 * time.Second
+
+// searchCost is how many messages SEARCH is charged as, it reads the
+// transcript from disk.
+const searchCost = 5
+
+// FloodPolicy decides what happens to a client going over its rate limits.
+type FloodPolicy int
+
+const (
+	// ThrottleFlooders stops reading from the client until its buckets
+	// refill, which slows it down to the allowed rate.
+	ThrottleFlooders FloodPolicy = iota
+	// WarnFlooders drops the commands over the limit and answers them with
+	// ERROR RATE_LIMITED.
+	WarnFlooders
+	// MuteFlooders drops every limited command of the client for the mute
+	// duration.
+	MuteFlooders
+	// DisconnectFlooders closes the connection of the client.
+	DisconnectFlooders
+)
+
+// SetMessageLimits limits the commands sent by a connection and by all
+// connections from one IP address, a zero Rate disables a limit and a zero
+// Burst defaults to Rate. It applies to clients connecting afterwards.
+func (s *TcpChatServer) SetMessageLimits(perConn, perIP RateLimit) {
+	s.messageLimit = perConn
+	s.ipMessageLimit = perIP
+}
+
+// SetByteLimits limits the bytes of text and file data sent like
+// SetMessageLimits.
+func (s *TcpChatServer) SetByteLimits(perConn, perIP RateLimit) {
+	s.byteLimit = perConn
+	s.ipByteLimit = perIP
+}
+
+// SetLoginLimits limits AUTH and REGISTER like SetMessageLimits.
+func (s *TcpChatServer) SetLoginLimits(perConn, perIP RateLimit) {
+	s.loginLimit = perConn
+	s.ipLoginLimit = perIP
+}
+
+func (s *TcpChatServer) SetFloodPolicy(policy FloodPolicy) {
+	s.floodPolicy = policy
+}
+
+// SetMuteDuration sets how long MuteFlooders silences a client.
+func (s *TcpChatServer) SetMuteDuration(duration time.Duration) {
+	s.muteDuration = duration
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Rate
+	}
+	return &tokenBucket{
+		limit:  limit,
+		tokens: limit.Burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		b.last = now
+	}
+	if b.tokens > b.limit.Burst {
+		b.tokens = b.limit.Burst
+	}
+}
+
+// wait returns how long until n tokens are available, a cost above the
+// burst is charged as the whole burst so large commands still get through.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b.limit.Rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	if n > b.limit.Burst {
+		n = b.limit.Burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if n > b.limit.Burst {
+		n = b.limit.Burst
+	}
+	b.tokens -= n
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	if b.limit.Rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= b.limit.Burst
+}
+
+// cost is what a command takes from the buckets of a limiter.
+type cost struct {
+	messages int
+	bytes    int
+	logins   int
+}
+
+type rateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+	logins   *tokenBucket
+	// conns counts the clients sharing an IP address limiter.
+	conns int
+}
+
+func newRateLimiter(messages, bytes, logins RateLimit, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		messages: newTokenBucket(messages, now),
+		bytes:    newTokenBucket(bytes, now),
+		logins:   newTokenBucket(logins, now),
+	}
+}
+
+// wait returns how long until the limiter allows a command and which of
+// its limits holds it back.
+func (l *rateLimiter) wait(c cost, now time.Time) (time.Duration, string) {
+	var wait time.Duration
+	var exceeded string
+	for _, b := range []struct {
+		bucket *tokenBucket
+		n      int
+		unit   string
+	}{
+		{l.messages, c.messages, "messages"},
+		{l.bytes, c.bytes, "bytes"},
+		{l.logins, c.logins, "logins"},
+	} {
+		if b.n == 0 {
+			continue
+		}
+		if bucketWait := b.bucket.wait(float64(b.n), now); bucketWait > wait {
+			wait = bucketWait
+			exceeded = fmt.Sprintf("%g %s/s", b.bucket.limit.Rate, b.unit)
+		}
+	}
+	return wait, exceeded
+}
+
+func (l *rateLimiter) take(c cost) {
+	l.messages.take(float64(c.messages))
+	l.bytes.take(float64(c.bytes))
+	l.logins.take(float64(c.logins))
+}
+
+func (l *rateLimiter) full(now time.Time) bool {
+	return l.messages.full(now) && l.bytes.full(now) && l.logins.full(now)
+}
+
+// ipOf returns the IP address clients are limited by, unix socket peers
+// have none.
+func ipOf(addr net.Addr) string {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP.String()
+	case gatewayAddr:
+		if host, _, err := net.SplitHostPort(v.addr); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// addRateLimits gives a new client its own limiter and a share of the one
+// of its IP address. Address limiters are kept after their last client
+// leaves until they refill, so reconnecting does not reset them.
+func (s *TcpChatServer) addRateLimits(client *client) {
+	now := time.Now()
+	client.limits = newRateLimiter(s.messageLimit, s.byteLimit, s.loginLimit, now)
+	ip := ipOf(client.Conn.RemoteAddr())
+	if ip == "" {
+		return
+	}
+	s.rateMutex.Lock()
+	defer s.rateMutex.Unlock()
+	for addr, limits := range s.ipLimits {
+		if limits.conns == 0 && limits.full(now) {
+			delete(s.ipLimits, addr)
+		}
+	}
+	limits, ok := s.ipLimits[ip]
+	if !ok {
+		limits = newRateLimiter(s.ipMessageLimit, s.ipByteLimit, s.ipLoginLimit, now)
+		s.ipLimits[ip] = limits
+	}
+	limits.conns++
+	client.ip = ip
+	client.ipLimits = limits
+}
+
+func (s *TcpChatServer) removeRateLimits(client *client) {
+	if client.ipLimits == nil {
+		return
+	}
+	s.rateMutex.Lock()
+	client.ipLimits.conns--
+	s.rateMutex.Unlock()
+}
+
+// floodCost returns what a command costs, the second result is false for
+// commands that are not limited.
+func floodCost(cmd protocol.Command) (cost, bool) {
+	switch v := cmd.(type) {
+	case protocol.SendCommand:
+		return cost{messages: 1, bytes: len(v.Message)}, true
+	case protocol.WhisperCommand:
+		return cost{messages: 1, bytes: len(v.Message)}, true
+	case protocol.EditCommand:
+		return cost{messages: 1, bytes: len(v.Message)}, true
+	case protocol.StatusCommand:
+		return cost{messages: 1, bytes: len(v.Text)}, true
+	case protocol.FileChunkCommand:
+		return cost{bytes: len(v.Data)}, true
+	case protocol.SearchCommand:
+		return cost{messages: searchCost}, true
+	case protocol.AuthCommand, protocol.RegisterCommand:
+		return cost{logins: 1}, true
+	case protocol.DeleteCommand, protocol.NameCommand, protocol.FileOfferCommand,
+		protocol.FileAcceptCommand, protocol.JoinCommand, protocol.PartCommand,
+		protocol.ListCommand, protocol.PingCommand:
+		return cost{messages: 1}, true
+	}
+	return cost{}, false
+}
+
+// limit charges cmd to the rate limits of the client and applies the flood
+// policy when they are exceeded. It reports whether the command may be
+// handled and whether the connection stays open.
+func (s *TcpChatServer) limit(client *client, cmd protocol.Command) (bool, bool) {
+	c, limited := floodCost(cmd)
+	if !limited {
+		return true, true
+	}
+	throttled := false
+	for {
+		now := time.Now()
+		if now.Before(client.mutedUntil) {
+			client.writeError(protocol.CodeRateLimited, fmt.Sprintf("you are muted for %v",
+				client.mutedUntil.Sub(now).Round(time.Second)))
+			return false, true
+		}
+		wait, exceeded := s.rateWait(client, c, now)
+		if wait == 0 {
+			client.flooding = throttled
+			return true, true
+		}
+		// Only the first command over the limit is logged, until the
+		// client is within its limits again.
+		first := !client.flooding
+		client.flooding = true
+		switch s.floodPolicy {
+		case ThrottleFlooders:
+			if first {
+				s.logFlood(client, exceeded, "throttling")
+			}
+			if !s.pause(client, wait) {
+				// Winding down, the next read fails and the
+				// client gets the shutdown notice.
+				return false, true
+			}
+			throttled = true
+		case WarnFlooders:
+			if first {
+				s.logFlood(client, exceeded, "dropping commands")
+			}
+			client.writeError(protocol.CodeRateLimited, "rate limit exceeded: "+exceeded)
+			return false, true
+		case MuteFlooders:
+			client.mutedUntil = now.Add(s.muteDuration)
+			client.flooding = false
+			s.logFlood(client, exceeded, fmt.Sprintf("muting for %v", s.muteDuration))
+			client.writeError(protocol.CodeRateLimited, fmt.Sprintf("rate limit exceeded: %v, you are muted for %v",
+				exceeded, s.muteDuration))
+			return false, true
+		default:
+			s.logFlood(client, exceeded, "disconnecting")
+			client.writeError(protocol.CodeRateLimited, "rate limit exceeded: "+exceeded)
+			return false, false
+		}
+	}
+}
+
+// rateWait takes the cost of a command from every limiter of the client if
+// all of them allow it, otherwise it returns the longest wait.
+func (s *TcpChatServer) rateWait(client *client, c cost, now time.Time) (time.Duration, string) {
+	s.rateMutex.Lock()
+	defer s.rateMutex.Unlock()
+	wait, exceeded := client.limits.wait(c, now)
+	if client.ipLimits != nil {
+		if ipWait, ipExceeded := client.ipLimits.wait(c, now); ipWait > wait {
+			wait = ipWait
+			exceeded = fmt.Sprintf("%v from %v", ipExceeded, client.ip)
+		}
+	}
+	if wait > 0 {
+		return wait, exceeded
+	}
+	client.limits.take(c)
+	if client.ipLimits != nil {
+		client.ipLimits.take(c)
+	}
+	return 0, ""
+}
+
+// pause waits for the buckets to refill, it returns false if the client is
+// wound down meanwhile.
+func (s *TcpChatServer) pause(client *client, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-client.windingDown:
+		return false
+	}
+}
+
+func (s *TcpChatServer) logFlood(client *client, exceeded, action string) {
+	s.logs <- fmt.Sprintf("%s Rate limit: %v [%v] exceeded %v, %v",
+		time.Now().Format("15:04"), client.Name, client.Addr, exceeded, action)
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// TestFloodCost checks that commands making the server send to the client
+// or to other users are charged.
+func TestFloodCost(t *testing.T) {
+	for _, cmd := range []protocol.Command{
+		protocol.SendCommand{Message: "hi"},
+		protocol.PingCommand{Token: "1"},
+		protocol.FileAcceptCommand{ID: "f1", From: "bob"},
+		protocol.ListCommand{},
+	} {
+		if c, limited := floodCost(cmd); !limited || c.messages == 0 {
+			t.Errorf("%v is not charged as a message", cmd.CommandName())
+		}
+	}
+	if _, limited := floodCost(protocol.PongCommand{Token: "1"}); limited {
+		t.Error("PONG is charged")
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+func (s *TcpChatServer) join(client *client, room string) {
+	if err := protocol.ValidRoomName(room); err != nil {
+		client.writeError(protocol.CodeBadRequest, err.Error())
+		return
+	}
+	previous := client.Room
+	if previous == room {
+		return
+	}
+	s.mutex.Lock()
+	client.Room = room
+	s.mutex.Unlock()
+	s.logs <- fmt.Sprintf("%s %v moved from #%v to #%v",
+		time.Now().Format("15:04"), client.Name, previous, room)
+	if client.Supports(protocol.FeatureRooms) {
+		client.send(protocol.JoinCommand{Room: room})
+	}
+	s.notifyClients()
+	s.updateUsers(previous)
+	s.updateUsers(room)
+}
+
+func (s *TcpChatServer) part(client *client, room string) {
+	if room == "" {
+		room = client.Room
+	}
+	if room != client.Room {
+		client.writeError(protocol.CodeBadRequest, fmt.Sprintf("you are not in #%v", room))
+		return
+	}
+	if room == protocol.LobbyRoom {
+		client.writeError(protocol.CodeNotPermitted, "you can not leave the lobby")
+		return
+	}
+	s.join(client, protocol.LobbyRoom)
+}
+
+func (s *TcpChatServer) list(client *client) {
+	client.send(protocol.RoomsCommand{Rooms: s.Rooms()})
+}
+
+// Rooms exist as long as somebody is in them, the lobby is always listed.
+func (s *TcpChatServer) Rooms() []protocol.RoomInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users := map[string]int{protocol.LobbyRoom: 0}
+	for _, client := range s.clients {
+		users[client.Room]++
+	}
+	var rooms []protocol.RoomInfo
+	for name, count := range users {
+		rooms = append(rooms, protocol.RoomInfo{
+			Name:  name,
+			Users: count,
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+func (s *TcpChatServer) RoomUsernames(room string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var users []string
+	for _, client := range s.clients {
+		if client.Room == room {
+			users = append(users, client.Name)
+		}
+	}
+	return users
+}
+
+// roomClients only returns clients that finished the handshake, the
+// features of those do not change anymore.
+func (s *TcpChatServer) roomClients(room string) []*client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var clients []*client
+	for _, client := range s.clients {
+		if client.greeted && client.Room == room {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func (s *TcpChatServer) BroadcastRoom(room string, command protocol.Command) error {
+	for _, client := range s.roomClients(room) {
+		client.send(command)
+	}
+	return nil
+}
+
+func (s *TcpChatServer) updateUsers(room string) {
+	s.BroadcastRoom(room, protocol.UsersCommand{
+		Users: s.RoomUsers(room),
+	})
+}
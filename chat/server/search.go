@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// DefaultSearchLimit is how many of the newest matches SEARCH returns.
+const DefaultSearchLimit = 100
+
+// SetTranscriptDir sets the directory room messages are stored in, an empty
+// dir keeps them in memory only and disables SEARCH. It must be called
+// before Start.
+func (s *TcpChatServer) SetTranscriptDir(dir string) {
+	if dir == "" {
+		s.transcript = nil
+		return
+	}
+	s.transcript = newTranscript(dir)
+}
+
+// openTranscript continues the message ids where the previous run stopped
+// and loads its recent messages for history and editing.
+func (s *TcpChatServer) openTranscript() error {
+	if s.transcript == nil {
+		return nil
+	}
+	lastID, err := s.transcript.open()
+	if err != nil {
+		return fmt.Errorf("transcript: %v", err)
+	}
+	recent, err := s.transcript.search(protocol.SearchCommand{}, s.messages.size, 0)
+	if err != nil {
+		return fmt.Errorf("transcript: %v", err)
+	}
+	// Segments are searched in file order, the log needs id order.
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].ID < recent[j].ID
+	})
+	for _, found := range recent {
+		s.messages.add(found.Room, "", protocol.MessageCommand{
+			ID:      found.ID,
+			Time:    found.Time,
+			Name:    found.Name,
+			Message: found.Message,
+		})
+	}
+	s.lastID = lastID
+	s.logs <- fmt.Sprintf("%s Transcript in %v, last message #%d",
+		time.Now().Format("15:04"), s.transcript.dir, lastID)
+	return nil
+}
+
+func (s *TcpChatServer) record(r record) {
+	if s.transcript == nil {
+		return
+	}
+	if r.time.IsZero() {
+		r.time = time.Now()
+	}
+	if err := s.transcript.append(r); err != nil {
+		s.logs <- fmt.Sprintf("%s Transcript error: %v",
+			time.Now().Format("15:04"), err)
+	}
+}
+
+func (s *TcpChatServer) recordMessage(room string, message protocol.MessageCommand) {
+	s.record(record{
+		kind:    recordMessage,
+		id:      message.ID,
+		time:    message.Time,
+		room:    room,
+		name:    message.Name,
+		message: message.Message,
+	})
+}
+
+func (s *TcpChatServer) search(client *client, query protocol.SearchCommand) {
+	if s.transcript == nil {
+		client.writeError(protocol.CodeBadRequest, "search is not available on this server")
+		return
+	}
+	if err := protocol.ValidSearch(query); err != nil {
+		client.writeError(protocol.CodeBadRequest, err.Error())
+		return
+	}
+	found, err := s.transcript.search(query, DefaultSearchLimit, historyBudget)
+	if err != nil {
+		s.logs <- fmt.Sprintf("%s Transcript error: %v",
+			time.Now().Format("15:04"), err)
+		client.writeError(protocol.CodeInternal, "transcript is unavailable")
+		return
+	}
+	client.send(protocol.ResultsCommand{Messages: found})
+}
+
+func (s *TcpChatServer) closeTranscript() {
+	if s.transcript == nil {
+		return
+	}
+	if err := s.transcript.close(); err != nil {
+		s.logs <- fmt.Sprintf("%s Transcript error: %v",
+			time.Now().Format("15:04"), err)
+	}
+}
@@ -1,139 +1,496 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/LeadNess/net-tools/chat/protocol"
 )
 
+// maxQueuedLogs bounds the log lines kept while nobody reads Logs().
+const maxQueuedLogs = 10000
+
 type ChatServer interface {
 	Listen(address string) error
-	Broadcast(command interface{}) error
+	Broadcast(command protocol.Command) error
+	BroadcastRoom(room string, command protocol.Command) error
 	ClientsUsernames() []string
-	Start()
+	RoomUsernames(room string) []string
+	RoomUsers(room string) []protocol.UserInfo
+	Rooms() []protocol.RoomInfo
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
 	Close() error
 	Logs() chan string
 	Clients() chan []*client
 }
 
 type TcpChatServer struct {
-	listener net.Listener
-	clients  []*client
-	mutex    *sync.Mutex
-	logs     chan string
-	clientsChan chan []*client
+	lastID       uint64
+	lastConn     uint64
+	lastClientID uint64
+	listeners    []net.Listener
+	clients      []*client
+	mutex        *sync.Mutex
+	logs         chan string
+	logLines     chan string
+	clientsChan  chan []*client
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+	maxFileSize  int64
+	maxFrameSize int
+	messages     *messageLog
+	operators    []string
+	autoAway     time.Duration
+	historySize  int
+	tls          *tlsFiles
+	accounts     *userStore
+	transcript   *transcript
+
+	queueSize     int
+	writeTimeout  time.Duration
+	slowConsumers SlowConsumerPolicy
+
+	messageLimit   RateLimit
+	ipMessageLimit RateLimit
+	byteLimit      RateLimit
+	ipByteLimit    RateLimit
+	loginLimit     RateLimit
+	ipLoginLimit   RateLimit
+	floodPolicy    FloodPolicy
+	muteDuration   time.Duration
+	// ipLimits is guarded by rateMutex, as are the buckets of every
+	// limiter.
+	ipLimits  map[string]*rateLimiter
+	rateMutex *sync.Mutex
+
+	transfers      map[string]*transfer
+	transfersMutex *sync.Mutex
+
+	httpListeners []net.Listener
+	ircListeners  []net.Listener
+
+	// conns maps every open connection to the function winding it down on
+	// Shutdown, guarded by mutex.
+	conns    map[net.Conn]func()
+	quit     chan struct{}
+	quitOnce *sync.Once
+
+	// sendMutex guards lastID, messages get their id, are stored and
+	// queued for the room under it so ids only ever grow, in the message
+	// log and for every client.
+	sendMutex *sync.Mutex
 }
 
 type client struct {
-	Conn   net.Conn
-	Name   string
-	writer *protocol.CommandWriter
+	Conn       net.Conn
+	connID     uint64
+	Addr       string
+	Name       string
+	Account    string
+	Room       string
+	Status     string
+	StatusText string
+	Version    int
+	Features   []string
+	Latency    time.Duration
+	writer     *protocol.CommandWriter
+	greeted    bool
+	done       chan struct{}
+
+	autoAway   bool
+	lastActive time.Time
+
+	// named is set once the client chose a name, before that it goes by
+	// its address.
+	named bool
+
+	queue    chan protocol.Command
+	policy   SlowConsumerPolicy
+	dropped  uint64
+	slow     chan struct{}
+	slowOnce *sync.Once
+	// written is closed once the writer has closed the connection.
+	written chan struct{}
+
+	// Only used by the serve goroutine, apart from the buckets.
+	limits     *rateLimiter
+	ip         string
+	ipLimits   *rateLimiter
+	flooding   bool
+	mutedUntil time.Time
+
+	// windingDown is closed by windDown, it ends a throttling pause.
+	windingDown  chan struct{}
+	windDownOnce *sync.Once
 }
 
-func NewServer() *TcpChatServer {
-	return &TcpChatServer{
-		mutex: &sync.Mutex{},
-		logs: make(chan string, 10),
-		clientsChan: make(chan []*client),
-	}
+func (c *client) Supports(feature string) bool {
+	return protocol.HasFeature(c.Features, feature)
 }
 
-func (s *TcpChatServer) Listen(address string) error {
-	l, err := net.Listen("tcp", address)
-	if err == nil {
-		s.listener = l
-		s.logs <- fmt.Sprintf("%s Listening on %v",
-			time.Now().Format("15:04"), address)
+func (c *client) writeError(code, message string) error {
+	return c.send(protocol.ErrorCommand{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// writePrivate falls back to a regular message for clients that do not
+// know about whispers.
+func (c *client) writePrivate(message protocol.PrivateMessageCommand) error {
+	if c.Supports(protocol.FeatureWhisper) {
+		return c.send(message)
 	}
-	return err
+	return c.send(protocol.MessageCommand{
+		Time:    time.Now(),
+		Name:    fmt.Sprintf("%v -> %v", message.From, message.To),
+		Message: message.Message,
+	})
 }
 
-func (s *TcpChatServer) Close() error {
-	return s.listener.Close()
+func NewServer() *TcpChatServer {
+	s := &TcpChatServer{
+		mutex:        &sync.Mutex{},
+		logs:         make(chan string, 10),
+		logLines:     make(chan string),
+		clientsChan:  make(chan []*client),
+		pingInterval: DefaultPingInterval,
+		idleTimeout:  DefaultIdleTimeout,
+		maxFileSize:  DefaultMaxFileSize,
+		maxFrameSize: protocol.DefaultMaxFrameSize,
+		messages:     newMessageLog(DefaultMessageLogSize),
+		autoAway:     DefaultAutoAway,
+		historySize:  DefaultHistorySize,
+		accounts:     newUserStore(DefaultUserStoreFile),
+		transcript:   newTranscript(DefaultTranscriptDir),
+
+		queueSize:    DefaultQueueSize,
+		writeTimeout: DefaultWriteTimeout,
+
+		messageLimit:   DefaultMessageLimit,
+		ipMessageLimit: DefaultIPMessageLimit,
+		byteLimit:      DefaultByteLimit,
+		ipByteLimit:    DefaultIPByteLimit,
+		loginLimit:     DefaultLoginLimit,
+		ipLoginLimit:   DefaultIPLoginLimit,
+		muteDuration:   DefaultMuteDuration,
+		ipLimits:       make(map[string]*rateLimiter),
+		rateMutex:      &sync.Mutex{},
+
+		transfers:      make(map[string]*transfer),
+		transfersMutex: &sync.Mutex{},
+
+		conns:    make(map[net.Conn]func()),
+		quit:     make(chan struct{}),
+		quitOnce: &sync.Once{},
+
+		sendMutex: &sync.Mutex{},
+	}
+	go s.queueLogs()
+	return s
 }
 
-func (s *TcpChatServer) Start() {
-	for {
-		conn, err := s.listener.Accept()
+// Listen opens a listener for address, "unix://path" listens on a unix
+// socket and anything else on TCP. It can be called several times to serve
+// clients on multiple addresses.
+func (s *TcpChatServer) Listen(address string) error {
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		tlsListener, err := s.listenTLS(l, address)
 		if err != nil {
-			log.Print(err)
-		} else {
-			client := s.accept(conn)
-			go s.serve(client)
+			l.Close()
+			return err
 		}
+		l = tlsListener
 	}
+	s.AddListener(l)
+	return nil
+}
+
+// AddListener serves clients accepted from l, it must be called before
+// Start.
+func (s *TcpChatServer) AddListener(l net.Listener) {
+	s.listeners = append(s.listeners, l)
+	s.logs <- fmt.Sprintf("%s Listening on %v",
+		time.Now().Format("15:04"), l.Addr())
+}
+
+// SetMaxFrameSize limits the size of a single command read from clients,
+// clients sending longer ones are disconnected.
+func (s *TcpChatServer) SetMaxFrameSize(size int) {
+	s.maxFrameSize = size
 }
 
 func (s *TcpChatServer) accept(conn net.Conn) *client {
-	s.logs <- fmt.Sprintf("%s Accepting connection from %v, total clients: %v",
-		time.Now().Format("15:04"), conn.RemoteAddr().String(), len(s.clients)+1)
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	addr := s.remoteAddr(conn)
 	client := &client{
-		Name:   conn.RemoteAddr().String(),
-		Conn:   conn,
-		writer: protocol.NewCommandWriter(conn),
+		Name:    addr,
+		Addr:    addr,
+		Room:    protocol.LobbyRoom,
+		Status:  protocol.StatusOnline,
+		Conn:    conn,
+		connID:  atomic.AddUint64(&s.lastClientID, 1),
+		Version: protocol.LegacyVersion,
+		writer:  protocol.NewCommandWriter(conn),
+		done:    make(chan struct{}),
+
+		lastActive: time.Now(),
+
+		queue:    make(chan protocol.Command, s.queueSize),
+		policy:   s.slowConsumers,
+		slow:     make(chan struct{}),
+		slowOnce: &sync.Once{},
+		written:  make(chan struct{}),
+
+		windingDown:  make(chan struct{}),
+		windDownOnce: &sync.Once{},
 	}
+	client.writer.SetVersion(client.Version)
+	s.addRateLimits(client)
+	s.mutex.Lock()
 	s.clients = append(s.clients, client)
+	s.conns[conn] = func() {
+		s.windDown(client)
+	}
+	total := len(s.clients)
+	s.mutex.Unlock()
+	s.logs <- fmt.Sprintf("%s Accepting connection from %v, total clients: %v",
+		time.Now().Format("15:04"), addr, total)
 	return client
 }
 
+// remove forgets the client, its writer goroutine flushes what is still
+// queued and closes the connection.
 func (s *TcpChatServer) remove(client *client) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 	for i, check := range s.clients {
 		if check == client {
 			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
 		}
 	}
+	s.mutex.Unlock()
 	s.logs <- fmt.Sprintf("%s Closing connection from %v",
-		time.Now().Format("15:04"), client.Conn.RemoteAddr().String())
+		time.Now().Format("15:04"), client.Addr)
+	close(client.done)
+	s.removeRateLimits(client)
+	s.dropTransfers(client)
 
-	s.clientsChan <- s.clients
-	go s.Broadcast(protocol.UsersCommand{
-		Users: strings.Join(s.ClientsUsernames(), " "),
-	})
+	s.notifyClients()
+	s.updateUsers(client.Room)
+}
 
-	client.Conn.Close()
+// notifyClients sends a copy of every client to Clients(), the copies can
+// be read while the clients keep changing.
+func (s *TcpChatServer) notifyClients() {
+	s.mutex.Lock()
+	clients := make([]*client, len(s.clients))
+	for i, c := range s.clients {
+		clients[i] = &client{
+			Conn:       c.Conn,
+			Addr:       c.Addr,
+			Name:       c.Name,
+			Account:    c.Account,
+			Room:       c.Room,
+			Status:     c.Status,
+			StatusText: c.StatusText,
+			Version:    c.Version,
+			Features:   c.Features,
+			Latency:    c.Latency,
+		}
+	}
+	s.mutex.Unlock()
+	s.clientsChan <- clients
 }
 
 func (s *TcpChatServer) serve(client *client) {
 	cmdReader := protocol.NewCommandReader(client.Conn)
-	defer s.remove(client)
+	cmdReader.SetMaxFrameSize(s.maxFrameSize)
+	// The connection counts as open for Shutdown until commands already
+	// read are handled and the queue is flushed, a failed write closes it
+	// while buffered commands are still being handled.
+	defer func() {
+		s.remove(client)
+		<-client.written
+		s.untrack(client.Conn)
+	}()
+	s.setReadDeadline(client)
+	if codec, err := cmdReader.DetectCodec(); err == nil {
+		client.writer.SetCodec(codec)
+		s.logs <- fmt.Sprintf("%s Client %v uses %v codec",
+			time.Now().Format("15:04"), client.Addr, codec.Name())
+	}
+	go s.writeLoop(client)
 	for {
+		s.setReadDeadline(client)
 		cmd, err := cmdReader.Read()
-		if err != nil && err != io.EOF {
+		if err == io.EOF {
+			break
+		} else if isTimeout(err) {
+			if !s.closing() {
+				s.logEvicted(client)
+			}
+			break
+		} else if err != nil {
 			s.logs <- fmt.Sprintf("%s Read error: %v",
 				time.Now().Format("15:04"), err)
-		}
-		if cmd != nil {
-			switch v := cmd.(type) {
-				case protocol.SendCommand:
-					go s.Broadcast(protocol.MessageCommand{
-						Message: v.Message,
-						Name:    client.Name,
-					})
-				case protocol.NameCommand:
-					client.Name = v.Name
-					s.clientsChan <- s.clients
-					go s.Broadcast(protocol.UsersCommand{
-						Users: strings.Join(s.ClientsUsernames(), " "),
-					})
+			reply, recoverable := protocol.ErrorFor(err)
+			if !recoverable {
+				if reply.Code != protocol.CodeInternal {
+					client.send(reply)
+				}
+				break
 			}
+			client.send(reply)
+			continue
 		}
-		if err == io.EOF {
+		if !s.handle(client, cmd) {
 			break
 		}
 	}
 }
 
+func (s *TcpChatServer) handle(client *client, cmd protocol.Command) bool {
+	if v, ok := cmd.(protocol.HelloCommand); ok {
+		return s.greet(client, v)
+	}
+	if !client.greeted {
+		s.mutex.Lock()
+		client.greeted = true
+		s.mutex.Unlock()
+	}
+	switch cmd.(type) {
+	case protocol.PingCommand, protocol.PongCommand:
+	default:
+		s.touch(client)
+	}
+	if ok, keep := s.limit(client, cmd); !ok {
+		return keep
+	}
+	switch v := cmd.(type) {
+	case protocol.SendCommand:
+		s.sendMessage(client, v.Message)
+	case protocol.WhisperCommand:
+		s.whisper(client, v)
+	case protocol.NameCommand:
+		s.setName(client, v.Name)
+	case protocol.AuthCommand, protocol.RegisterCommand:
+		s.authenticate(client, v)
+	case protocol.JoinCommand:
+		s.join(client, v.Room)
+	case protocol.PartCommand:
+		s.part(client, v.Room)
+	case protocol.ListCommand:
+		s.list(client)
+	case protocol.SearchCommand:
+		s.search(client, v)
+	case protocol.PingCommand:
+		client.send(protocol.PongCommand{Token: v.Token})
+	case protocol.PongCommand:
+		s.pong(client, v)
+	case protocol.FileOfferCommand:
+		s.offerFile(client, v)
+	case protocol.FileAcceptCommand:
+		s.acceptFile(client, v)
+	case protocol.FileChunkCommand:
+		s.relayChunk(client, v)
+	case protocol.EditCommand:
+		s.editMessage(client, v)
+	case protocol.DeleteCommand:
+		s.deleteMessage(client, v)
+	case protocol.StatusCommand:
+		s.setStatus(client, v)
+	}
+	return true
+}
+
+func (s *TcpChatServer) whisper(sender *client, whisper protocol.WhisperCommand) {
+	message := protocol.PrivateMessageCommand{
+		From:    sender.Name,
+		To:      whisper.To,
+		Message: whisper.Message,
+	}
+	recipients := s.clientsByName(whisper.To)
+	if len(recipients) == 0 {
+		sender.writeError(protocol.CodeNoSuchUser, fmt.Sprintf("no such user: %v", whisper.To))
+		return
+	}
+	for _, recipient := range recipients {
+		if recipient == sender {
+			continue
+		}
+		if err := recipient.writePrivate(message); err != nil {
+			log.Printf("Whisper error: %v", err)
+		}
+	}
+	if err := sender.writePrivate(message); err != nil {
+		log.Printf("Whisper error: %v", err)
+	}
+}
+
+func (s *TcpChatServer) clientsByName(name string) []*client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var clients []*client
+	for _, client := range s.clients {
+		if client.greeted && client.Name == name {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func (s *TcpChatServer) greet(client *client, hello protocol.HelloCommand) bool {
+	if client.greeted {
+		s.logs <- fmt.Sprintf("%s Unexpected HELLO from %v",
+			time.Now().Format("15:04"), client.Addr)
+		return true
+	}
+	welcome, err := protocol.Negotiate(hello)
+	s.mutex.Lock()
+	client.greeted = true
+	if err == nil {
+		client.Version = welcome.Version
+		client.Features = welcome.Features
+		client.writer.SetVersion(welcome.Version)
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		s.reject(client, err)
+		return false
+	}
+	s.logs <- fmt.Sprintf("%s Client %v speaks protocol v%d, features: [%s]",
+		time.Now().Format("15:04"), client.Addr,
+		welcome.Version, strings.Join(welcome.Features, ", "))
+	if err := client.send(welcome); err != nil {
+		return false
+	}
+	if client.Supports(protocol.FeaturePing) {
+		go s.heartbeat(client)
+	}
+	return true
+}
+
+func (s *TcpChatServer) reject(client *client, reason error) {
+	s.logs <- fmt.Sprintf("%s Rejecting %v: %v",
+		time.Now().Format("15:04"), client.Addr, reason)
+	client.send(protocol.RejectCommand{Reason: reason.Error()})
+}
+
 func (s *TcpChatServer) ClientsUsernames() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	var users []string
 	for _, client := range s.clients {
 		users = append(users, client.Name)
@@ -141,19 +498,50 @@ func (s *TcpChatServer) ClientsUsernames() []string {
 	return users
 }
 
-func (s *TcpChatServer) Broadcast(command interface{}) error {
+func (s *TcpChatServer) Broadcast(command protocol.Command) error {
+	s.mutex.Lock()
+	var clients []*client
 	for _, client := range s.clients {
-		if err := client.writer.Write(command); err != nil {
-			log.Printf("Broadcast error: %v", err)
+		if client.greeted {
+			clients = append(clients, client)
 		}
 	}
+	s.mutex.Unlock()
+	for _, client := range clients {
+		client.send(command)
+	}
 	return nil
 }
 
+// Logs returns the server's log lines, they are queued until read so the
+// server can be set up before anybody shows them.
 func (s *TcpChatServer) Logs() chan string {
-	return s.logs
+	return s.logLines
+}
+
+// queueLogs moves lines from logs to Logs() without ever holding the
+// writers up, the oldest lines are dropped once maxQueuedLogs are waiting.
+func (s *TcpChatServer) queueLogs() {
+	var queue []string
+	for {
+		var next string
+		var out chan string
+		if len(queue) > 0 {
+			next = queue[0]
+			out = s.logLines
+		}
+		select {
+		case line := <-s.logs:
+			if len(queue) == maxQueuedLogs {
+				queue = queue[1:]
+			}
+			queue = append(queue, line)
+		case out <- next:
+			queue = queue[1:]
+		}
+	}
 }
 
 func (s *TcpChatServer) Clients() chan []*client {
 	return s.clientsChan
-}
\ No newline at end of file
+}
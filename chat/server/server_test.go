@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+type testServer struct {
+	*TcpChatServer
+	addr     string
+	done     chan error
+	logs     chan []string
+	stopOnce *sync.Once
+}
+
+// startServer serves on a random local port until the test ends, with rate
+// limits lifted so the clients of a test are never throttled unless setup
+// sets them. The test fails if the server logged a transcript error.
+func startServer(t *testing.T, setup func(*TcpChatServer)) *testServer {
+	dir := t.TempDir()
+	s := &testServer{
+		TcpChatServer: NewServer(),
+		done:          make(chan error, 1),
+		logs:          make(chan []string),
+		stopOnce:      &sync.Once{},
+	}
+	s.SetTranscriptDir(filepath.Join(dir, "transcript"))
+	s.SetUserStore(filepath.Join(dir, "users"))
+	s.SetMessageLimits(RateLimit{}, RateLimit{})
+	s.SetByteLimits(RateLimit{}, RateLimit{})
+	s.SetLoginLimits(RateLimit{}, RateLimit{})
+	if setup != nil {
+		setup(s.TcpChatServer)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = l.Addr().String()
+	s.AddListener(l)
+	go func() {
+		var lines []string
+		for line := range s.Logs() {
+			if line == "" {
+				s.logs <- lines
+			}
+			lines = append(lines, line)
+		}
+	}()
+	go func() {
+		for range s.Clients() {
+		}
+	}()
+	go func() {
+		s.done <- s.Start(context.Background())
+	}()
+	t.Cleanup(func() {
+		s.stop(t)
+		for _, line := range s.logLines() {
+			if strings.Contains(line, "Transcript error") {
+				t.Error(line)
+			}
+		}
+	})
+	return s
+}
+
+// stop shuts the server down and waits for Start to return.
+func (s *testServer) stop(t *testing.T) {
+	s.stopOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		if err := <-s.done; err != ErrServerClosed {
+			t.Errorf("Start returned %v", err)
+		}
+	})
+}
+
+// logLines returns what the server logged so far.
+func (s *testServer) logLines() []string {
+	// Lines are queued in order, so the empty one comes last.
+	s.TcpChatServer.logs <- ""
+	return <-s.logs
+}
+
+type testClient struct {
+	conn   net.Conn
+	writer *protocol.CommandWriter
+	reader *protocol.CommandReader
+}
+
+// dial connects and greets the server in codec, the commands it answers
+// with are read and dropped in the background until the connection closes.
+func dial(t *testing.T, addr string, codec protocol.Codec) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	c := &testClient{
+		conn:   conn,
+		writer: protocol.NewCommandWriter(conn),
+		reader: protocol.NewCommandReader(conn),
+	}
+	c.writer.SetCodec(codec)
+	c.reader.SetCodec(codec)
+	c.write(protocol.HelloCommand{Version: protocol.Version, Features: protocol.Features})
+	go func() {
+		for {
+			if _, err := c.reader.Read(); err != nil {
+				if _, bad := err.(protocol.BadCommand); !bad {
+					return
+				}
+			}
+		}
+	}()
+	return c
+}
+
+func (c *testClient) write(command protocol.Command) {
+	// Writes fail once the server drops the client, which the test does
+	// not care about.
+	c.writer.Write(command)
+}
+
+// TestConcurrentClients connects clients speaking every codec which send,
+// rename, change rooms and disconnect all at once while the server is
+// queried, run it with -race.
+func TestConcurrentClients(t *testing.T) {
+	const (
+		clients = 12
+		rounds  = 30
+	)
+	s := startServer(t, nil)
+	codecs := []protocol.Codec{protocol.TextCodec, protocol.BinaryCodec, protocol.JSONCodec}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dial(t, s.addr, codecs[i%len(codecs)])
+			if c == nil {
+				return
+			}
+			defer c.conn.Close()
+			c.write(protocol.NameCommand{Name: fmt.Sprintf("user%d", i)})
+			for round := 0; round < rounds; round++ {
+				c.write(protocol.SendCommand{Message: fmt.Sprintf("message %d from %d", round, i)})
+				switch round % 6 {
+				case 1:
+					c.write(protocol.JoinCommand{Room: fmt.Sprintf("room%d", (i+round)%3)})
+				case 2:
+					// Clients take each other's old names.
+					c.write(protocol.NameCommand{Name: fmt.Sprintf("user%d-%d", (i+1)%clients, round-1)})
+				case 3:
+					c.write(protocol.WhisperCommand{To: fmt.Sprintf("user%d", (i+1)%clients), Message: "psst"})
+				case 4:
+					c.write(protocol.ListCommand{})
+				case 5:
+					c.write(protocol.PartCommand{})
+				default:
+					c.write(protocol.NameCommand{Name: fmt.Sprintf("user%d-%d", i, round)})
+				}
+			}
+			// Every other client disconnects halfway and comes back.
+			if i%2 == 0 {
+				c.conn.Close()
+				c = dial(t, s.addr, codecs[i%len(codecs)])
+				if c == nil {
+					return
+				}
+				defer c.conn.Close()
+				c.write(protocol.NameCommand{Name: fmt.Sprintf("user%d", i)})
+				c.write(protocol.JoinCommand{Room: "room0"})
+				c.write(protocol.SendCommand{Message: "back"})
+			}
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	queried := make(chan struct{})
+	go func() {
+		defer close(queried)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.ClientsUsernames()
+			s.Rooms()
+			s.RoomUsernames("room0")
+			s.RoomUsers(protocol.LobbyRoom)
+			s.Broadcast(protocol.MessageCommand{Time: time.Now(), Name: "server", Message: "hello all"})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-queried
+
+	// The server keeps working once everybody is gone.
+	c := dial(t, s.addr, protocol.TextCodec)
+	if c == nil {
+		return
+	}
+	defer c.conn.Close()
+	c.write(protocol.NameCommand{Name: "last"})
+	deadline := time.Now().Add(5 * time.Second)
+	for !contains(s.ClientsUsernames(), "last") {
+		if time.Now().After(deadline) {
+			t.Fatalf("last client not named, clients are %v", s.ClientsUsernames())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// TestShutdownWaitsForReader makes the writer of a client fail while its
+// reader is throttled with commands left in its buffer, Shutdown must still
+// wait for the reader before closing the transcript.
+func TestShutdownWaitsForReader(t *testing.T) {
+	const pause = 200 * time.Millisecond
+	s := startServer(t, func(s *TcpChatServer) {
+		s.SetMessageLimits(RateLimit{Rate: float64(time.Second / pause), Burst: 1}, RateLimit{})
+	})
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// One write, so the server reads every command at once.
+	fmt.Fprintf(conn, "HELLO %d %s\nNAME slow\nSEND one\nSEND two\n",
+		protocol.Version, strings.Join(protocol.Features, ","))
+	var slow *client
+	deadline := time.Now().Add(5 * time.Second)
+	for slow == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("client not named")
+		}
+		time.Sleep(10 * time.Millisecond)
+		s.mutex.Lock()
+		for _, c := range s.clients {
+			if c.Name == "slow" {
+				slow = c
+			}
+		}
+		s.mutex.Unlock()
+	}
+
+	// Resetting the connection fails the next write.
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	s.Broadcast(protocol.MessageCommand{Time: time.Now(), Name: "server", Message: "hello all"})
+	select {
+	case <-slow.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still running")
+	}
+
+	s.stop(t)
+	// Give a reader that was not waited for the time to wake up and store
+	// its SEND, which logs a transcript error.
+	time.Sleep(2 * pause)
+}
+
+// TestMessageLogOrder sends from several clients at once, the message log
+// has to stay ordered by id for edits and deletes to find the messages.
+func TestMessageLogOrder(t *testing.T) {
+	const (
+		clients  = 8
+		messages = 50
+	)
+	s := startServer(t, nil)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dial(t, s.addr, protocol.TextCodec)
+			if c == nil {
+				return
+			}
+			defer c.conn.Close()
+			for j := 0; j < messages; j++ {
+				c.write(protocol.SendCommand{Message: fmt.Sprintf("message %d from %d", j, i)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var ids []uint64
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ids) < clients*messages {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d messages stored", len(ids), clients*messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+		s.messages.mutex.Lock()
+		ids = ids[:0]
+		for _, message := range s.messages.messages {
+			ids = append(ids, message.ID)
+		}
+		s.messages.mutex.Unlock()
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("message #%d stored after #%d", ids[i], ids[i-1])
+		}
+	}
+}
+
+// TestMessageIDsIncrease checks that a room member gets the messages of
+// clients sending at once with growing ids.
+func TestMessageIDsIncrease(t *testing.T) {
+	const (
+		clients  = 8
+		messages = 50
+	)
+	s := startServer(t, nil)
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writer := protocol.NewCommandWriter(conn)
+	writer.Write(protocol.HelloCommand{Version: protocol.Version})
+	writer.Write(protocol.NameCommand{Name: "listener"})
+	deadline := time.Now().Add(5 * time.Second)
+	for !contains(s.ClientsUsernames(), "listener") {
+		if time.Now().After(deadline) {
+			t.Fatal("listener not named")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < clients; i++ {
+		go func(i int) {
+			c := dial(t, s.addr, protocol.TextCodec)
+			if c == nil {
+				return
+			}
+			defer c.conn.Close()
+			for j := 0; j < messages; j++ {
+				c.write(protocol.SendCommand{Message: fmt.Sprintf("message %d from %d", j, i)})
+			}
+		}(i)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := protocol.NewCommandReader(conn)
+	var last uint64
+	for received := 0; received < clients*messages; {
+		command, err := reader.Read()
+		if err != nil {
+			t.Fatalf("after %d messages: %v", received, err)
+		}
+		message, ok := command.(protocol.MessageCommand)
+		if !ok {
+			continue
+		}
+		if message.ID <= last {
+			t.Fatalf("got message #%d after #%d", message.ID, last)
+		}
+		last = message.ID
+		received++
+	}
+}
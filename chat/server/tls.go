@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	generate bool
+}
+
+// SetTLS makes Listen serve TLS with the given PEM certificate and key.
+// With generate set a self-signed certificate is created when the files do
+// not exist yet, clients pin it on first use.
+func (s *TcpChatServer) SetTLS(certFile, keyFile string, generate bool) {
+	s.tls = &tlsFiles{certFile: certFile, keyFile: keyFile, generate: generate}
+}
+
+func (s *TcpChatServer) listenTLS(l net.Listener, address string) (net.Listener, error) {
+	cert, err := loadCertificate(s.tls, address)
+	if err != nil {
+		return nil, err
+	}
+	s.logs <- fmt.Sprintf("%s Certificate fingerprint %s",
+		time.Now().Format("15:04"), protocol.Fingerprint(cert.Certificate[0]))
+	return tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+func loadCertificate(files *tlsFiles, address string) (tls.Certificate, error) {
+	_, err := os.Stat(files.certFile)
+	if os.IsNotExist(err) && files.generate {
+		if err := generateCertificate(files.certFile, files.keyFile, address); err != nil {
+			return tls.Certificate{}, fmt.Errorf("generate certificate: %v", err)
+		}
+	}
+	return tls.LoadX509KeyPair(files.certFile, files.keyFile)
+}
+
+func generateCertificate(certFile, keyFile, address string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
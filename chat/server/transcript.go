@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// The transcript keeps every room message, edit and deletion in a directory
+// of append-only segments. A segment is a log of quoted records, one per
+// line,
+//
+//	MESSAGE <id> <time> <room> <name> <message>
+//	EDIT <id> <time> <room> "" <message>
+//	DELETE <id> <time> <room> "" ""
+//
+// and an index with an entry of id, time in unix nanoseconds and log offset
+// per record, big endian uint64s. Segments are named after the id of their
+// first record, or one above the highest id of the previous segment when
+// that record changes an older message, so names only grow. Only the last
+// segment is written to, it is checked and its index rebuilt when the
+// transcript is opened.
+const (
+	DefaultTranscriptDir = "transcript"
+	DefaultSegmentSize   = 4 << 20
+)
+
+const (
+	recordMessage = "MESSAGE"
+	recordEdit    = "EDIT"
+	recordDelete  = "DELETE"
+
+	indexEntrySize = 24
+
+	// Messages are stamped before they are appended, so the log is only
+	// roughly ordered by time.
+	clockSkew = time.Second
+)
+
+var errTranscriptClosed = errors.New("transcript is closed")
+
+type record struct {
+	kind    string
+	id      uint64
+	time    time.Time
+	room    string
+	name    string
+	message string
+}
+
+func (r record) encode() []byte {
+	return []byte(protocol.JoinFields([]string{
+		r.kind,
+		strconv.FormatUint(r.id, 10),
+		r.time.UTC().Format(time.RFC3339Nano),
+		r.room,
+		r.name,
+		r.message,
+	}) + "\n")
+}
+
+func decodeRecord(line string) (record, error) {
+	fields, err := protocol.SplitFields(line)
+	if err != nil {
+		return record{}, err
+	}
+	if len(fields) != 6 {
+		return record{}, fmt.Errorf("record has %d fields", len(fields))
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return record{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[2])
+	if err != nil {
+		return record{}, err
+	}
+	return record{
+		kind:    fields[0],
+		id:      id,
+		time:    t,
+		room:    fields[3],
+		name:    fields[4],
+		message: fields[5],
+	}, nil
+}
+
+type segment struct {
+	// path without the .log and .idx extensions
+	path    string
+	first   uint64
+	size    int64
+	entries int64
+	last    time.Time
+	// lastID is the highest id recorded in the segment.
+	lastID uint64
+}
+
+func newSegment(path string) (*segment, error) {
+	first, err := strconv.ParseUint(filepath.Base(path), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s.log: not a transcript segment", path)
+	}
+	return &segment{
+		path:  path,
+		first: first,
+	}, nil
+}
+
+// load reads the size of a complete segment, its highest id and the time of
+// its last record.
+func (s *segment) load() error {
+	info, err := os.Stat(s.path + ".log")
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+	index, err := os.Open(s.path + ".idx")
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	entries, err := ioutil.ReadAll(index)
+	if err != nil {
+		return err
+	}
+	s.entries = int64(len(entries) / indexEntrySize)
+	for i := int64(0); i < s.entries; i++ {
+		entry := entries[i*indexEntrySize:]
+		if id := binary.BigEndian.Uint64(entry); id > s.lastID {
+			s.lastID = id
+		}
+		s.last = time.Unix(0, int64(binary.BigEndian.Uint64(entry[8:])))
+	}
+	return nil
+}
+
+// highestID is the highest id used by the segment, including its name.
+func (s *segment) highestID() uint64 {
+	if s.lastID > s.first {
+		return s.lastID
+	}
+	return s.first
+}
+
+// recover drops a record cut short by a crash from the end of the log and
+// rebuilds the index from it.
+func (s *segment) recover() error {
+	data, err := ioutil.ReadFile(s.path + ".log")
+	if err != nil {
+		return err
+	}
+	var index []byte
+	var offset int
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			break
+		}
+		r, err := decodeRecord(string(data[offset : offset+end]))
+		if err != nil {
+			break
+		}
+		index = append(index, indexEntry(r, int64(offset))...)
+		if r.id > s.lastID {
+			s.lastID = r.id
+		}
+		s.last = r.time
+		offset += end + 1
+	}
+	if offset < len(data) {
+		if err := os.Truncate(s.path+".log", int64(offset)); err != nil {
+			return err
+		}
+	}
+	s.size = int64(offset)
+	s.entries = int64(len(index) / indexEntrySize)
+	return ioutil.WriteFile(s.path+".idx", index, 0600)
+}
+
+func indexEntry(r record, offset int64) []byte {
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry, r.id)
+	binary.BigEndian.PutUint64(entry[8:], uint64(r.time.UnixNano()))
+	binary.BigEndian.PutUint64(entry[16:], uint64(offset))
+	return entry
+}
+
+// read returns the records appended at or after from, the index is used to
+// skip the older ones.
+func (s segment) read(from time.Time) ([]record, error) {
+	offset, err := s.seek(from)
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.Open(s.path + ".log")
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+	var records []record
+	reader := bufio.NewReader(io.NewSectionReader(log, offset, s.size-offset))
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		r, err := decodeRecord(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("%s.log: %v", s.path, err)
+		}
+		records = append(records, r)
+	}
+}
+
+func (s segment) seek(from time.Time) (int64, error) {
+	if from.IsZero() || s.entries == 0 {
+		return 0, nil
+	}
+	index, err := ioutil.ReadFile(s.path + ".idx")
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(index)) < s.entries*indexEntrySize {
+		return 0, fmt.Errorf("%s.idx: index is truncated", s.path)
+	}
+	i := sort.Search(int(s.entries), func(i int) bool {
+		t := int64(binary.BigEndian.Uint64(index[i*indexEntrySize+8:]))
+		return t >= from.UnixNano()
+	})
+	if i == int(s.entries) {
+		return s.size, nil
+	}
+	return int64(binary.BigEndian.Uint64(index[i*indexEntrySize+16:])), nil
+}
+
+type transcript struct {
+	mutex       *sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []*segment
+	log         *os.File
+	index       *os.File
+	closed      bool
+}
+
+func newTranscript(dir string) *transcript {
+	return &transcript{
+		mutex:       &sync.Mutex{},
+		dir:         dir,
+		segmentSize: DefaultSegmentSize,
+	}
+}
+
+// open loads the segments and returns the last message id used.
+func (t *transcript) open() (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return 0, err
+	}
+	paths, err := filepath.Glob(filepath.Join(t.dir, "*.log"))
+	if err != nil {
+		return 0, err
+	}
+	// Names are zero padded, so they sort by id.
+	sort.Strings(paths)
+	t.segments = nil
+	for i, path := range paths {
+		seg, err := newSegment(strings.TrimSuffix(path, ".log"))
+		if err != nil {
+			return 0, err
+		}
+		if i == len(paths)-1 {
+			err = seg.recover()
+		} else {
+			err = seg.load()
+		}
+		if err != nil {
+			return 0, err
+		}
+		t.segments = append(t.segments, seg)
+	}
+	// Edits and deletes of old messages can be anywhere and segment names
+	// can be above every id, the highest id recorded counts.
+	var lastID uint64
+	for _, seg := range t.segments {
+		if seg.lastID > lastID {
+			lastID = seg.lastID
+		}
+	}
+	return lastID, nil
+}
+
+func (t *transcript) append(r record) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return errTranscriptClosed
+	}
+	if t.log == nil || t.segments[len(t.segments)-1].size >= t.segmentSize {
+		if err := t.roll(r.id); err != nil {
+			return err
+		}
+	}
+	seg := t.segments[len(t.segments)-1]
+	line := r.encode()
+	if _, err := t.log.Write(line); err != nil {
+		return err
+	}
+	if _, err := t.index.Write(indexEntry(r, seg.size)); err != nil {
+		return err
+	}
+	seg.size += int64(len(line))
+	seg.entries++
+	seg.last = r.time
+	if r.id > seg.lastID {
+		seg.lastID = r.id
+	}
+	return nil
+}
+
+// roll opens the segment appended to, the last one unless it is full.
+func (t *transcript) roll(id uint64) error {
+	t.closeFiles()
+	n := len(t.segments)
+	if n == 0 || t.segments[n-1].size >= t.segmentSize {
+		if n > 0 && id <= t.segments[n-1].highestID() {
+			id = t.segments[n-1].highestID() + 1
+		}
+		seg, err := newSegment(filepath.Join(t.dir, fmt.Sprintf("%020d", id)))
+		if err != nil {
+			return err
+		}
+		t.segments = append(t.segments, seg)
+	}
+	seg := t.segments[len(t.segments)-1]
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	log, err := os.OpenFile(seg.path+".log", flags, 0600)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(seg.path+".idx", flags, 0600)
+	if err != nil {
+		log.Close()
+		return err
+	}
+	t.log = log
+	t.index = index
+	return nil
+}
+
+func (t *transcript) closeFiles() error {
+	if t.log == nil {
+		return nil
+	}
+	err := t.log.Close()
+	if indexErr := t.index.Close(); err == nil {
+		err = indexErr
+	}
+	t.log = nil
+	t.index = nil
+	return err
+}
+
+func (t *transcript) close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	return t.closeFiles()
+}
+
+// search returns up to limit of the newest messages matching query, oldest
+// first and with edits applied. The messages returned fit into budget bytes
+// unless it is zero.
+func (t *transcript) search(query protocol.SearchCommand, limit, budget int) ([]protocol.FoundMessage, error) {
+	t.mutex.Lock()
+	segments := make([]segment, len(t.segments))
+	for i, seg := range t.segments {
+		segments[i] = *seg
+	}
+	t.mutex.Unlock()
+
+	var from time.Time
+	if !query.Since.IsZero() {
+		from = query.Since.Add(-clockSkew)
+	}
+	// Segments are read newest first, so changes are seen before the
+	// messages they apply to.
+	changes := make(map[uint64]record)
+	var found []protocol.FoundMessage
+scan:
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].entries == 0 {
+			continue
+		}
+		if segments[i].last.Before(from) {
+			break
+		}
+		records, err := segments[i].read(from)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(records) - 1; j >= 0; j-- {
+			r := records[j]
+			if r.kind != recordMessage {
+				if _, ok := changes[r.id]; !ok {
+					changes[r.id] = r
+				}
+				continue
+			}
+			if change, ok := changes[r.id]; ok {
+				if change.kind == recordDelete {
+					continue
+				}
+				r.message = change.message
+			}
+			if !matches(query, r) {
+				continue
+			}
+			if budget > 0 {
+				// Room for the id and timestamp fields.
+				if budget -= len(r.room) + len(r.name) + len(r.message) + 64; budget < 0 {
+					break scan
+				}
+			}
+			found = append(found, protocol.FoundMessage{
+				ID:      r.id,
+				Time:    r.time,
+				Room:    r.room,
+				Name:    r.name,
+				Message: r.message,
+			})
+			if len(found) == limit {
+				break scan
+			}
+		}
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, nil
+}
+
+func matches(query protocol.SearchCommand, r record) bool {
+	if query.Room != "" && query.Room != r.room {
+		return false
+	}
+	if query.Name != "" && !strings.EqualFold(query.Name, r.name) {
+		return false
+	}
+	if !query.Since.IsZero() && r.time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !r.time.Before(query.Until) {
+		return false
+	}
+	return query.Text == "" || strings.Contains(strings.ToLower(r.message), strings.ToLower(query.Text))
+}
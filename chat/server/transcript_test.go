@@ -0,0 +1,49 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTranscriptLastID fills segments of one record each, so an edit of an
+// old message starts a segment, and checks the id reopening continues from.
+func TestTranscriptLastID(t *testing.T) {
+	dir := t.TempDir()
+	tr := newTranscript(dir)
+	if _, err := tr.open(); err != nil {
+		t.Fatal(err)
+	}
+	tr.segmentSize = 1
+	records := []record{
+		{kind: recordMessage, id: 1, room: "lobby", name: "bob", message: "one"},
+		{kind: recordMessage, id: 2, room: "lobby", name: "bob", message: "two"},
+		{kind: recordEdit, id: 1, room: "lobby", message: "first"},
+		{kind: recordMessage, id: 3, room: "lobby", name: "bob", message: "three"},
+		{kind: recordDelete, id: 2, room: "lobby"},
+	}
+	for _, r := range records {
+		r.time = time.Now()
+		if err := tr.append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.close(); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(records) {
+		t.Fatalf("%d segments, want %d", len(paths), len(records))
+	}
+
+	lastID, err := newTranscript(dir).open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != 3 {
+		t.Errorf("last id %d, want 3", lastID)
+	}
+}
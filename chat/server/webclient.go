@@ -0,0 +1,148 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+// webClientHTML is the browser client served by ListenHTTP, it speaks the
+// JSON codec over WebSocket. PROTOCOL_VERSION is filled in by webClientPage.
+const webClientHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TCP Chat</title>
+<style>
+body { font-family: monospace; margin: 0; display: flex; height: 100vh; }
+#main { flex: 1; display: flex; flex-direction: column; }
+#history { flex: 1; overflow-y: auto; padding: 8px; }
+#users { width: 200px; border-left: 1px solid #ccc; padding: 8px; }
+#input { border: none; border-top: 1px solid #ccc; padding: 8px; font: inherit; }
+.whisper { color: #a0a; }
+.error { color: #c00; }
+.time, .id, .history { color: #888; }
+.separator { color: #888; text-align: center; }
+</style>
+</head>
+<body>
+<div id="main">
+  <div id="history"></div>
+  <input id="input" placeholder="Your name" autofocus>
+</div>
+<div id="users"><b id="room">#lobby</b><ul id="roster"></ul></div>
+<script>
+var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+var input = document.getElementById("input");
+var historyBox = document.getElementById("history");
+var named = false;
+
+function send(command, payload) {
+  ws.send(JSON.stringify({command: command, payload: payload}));
+}
+
+function show(text, cls, id) {
+  var row = document.createElement("div");
+  row.textContent = text;
+  if (cls) row.className = cls;
+  if (id) row.id = "message-" + id;
+  historyBox.appendChild(row);
+  historyBox.scrollTop = historyBox.scrollHeight;
+}
+
+function line(m) {
+  var time = new Date(m.time).toLocaleTimeString();
+  return time + " #" + m.id + " " + m.name + ": " + m.message;
+}
+
+ws.onopen = function () {
+  send("HELLO", {version: PROTOCOL_VERSION, features: ["whisper", "rooms", "ping", "edit", "history", "nick"]});
+};
+
+ws.onclose = function () {
+  show("Disconnected", "error");
+};
+
+ws.onmessage = function (event) {
+  var msg = JSON.parse(event.data), p = msg.payload || {};
+  switch (msg.command) {
+  case "WELCOME":
+    show("Connected, enter your name below");
+    break;
+  case "REJECT":
+    show("Rejected: " + p.reason, "error");
+    break;
+  case "MESSAGE":
+    show(line(p), "", p.id);
+    break;
+  case "HISTORY":
+    (p.messages || []).forEach(function (m) {
+      show(line(m), "history", m.id);
+    });
+    if (p.messages && p.messages.length) show("--- new messages ---", "separator");
+    break;
+  case "PRIVATE":
+    show(p.from + " -> " + p.to + ": " + p.message, "whisper");
+    break;
+  case "EDIT":
+  case "DELETE":
+    var row = document.getElementById("message-" + p.id);
+    if (row) row.textContent = row.textContent.replace(/: .*$/, ": " + (p.message || "(deleted)"));
+    break;
+  case "USERS":
+    var roster = document.getElementById("roster");
+    roster.textContent = "";
+    (p.users || []).forEach(function (u) {
+      var item = document.createElement("li");
+      item.textContent = u.name + (u.status && u.status !== "online" ? " [" + u.status + "]" : "");
+      roster.appendChild(item);
+    });
+    break;
+  case "RENAME":
+    if (p.from) show(p.from + " is now known as " + p.to);
+    break;
+  case "JOIN":
+    document.getElementById("room").textContent = "#" + p.room;
+    break;
+  case "ERROR":
+    show(p.code + ": " + p.message, "error");
+    if (p.code === "INVALID_NAME" || p.code === "NAME_TAKEN") {
+      named = false;
+      input.placeholder = "Your name";
+    }
+    break;
+  case "PING":
+    send("PONG", {token: p.token});
+    break;
+  }
+};
+
+input.onkeydown = function (event) {
+  if (event.key !== "Enter" || input.value === "") return;
+  var text = input.value, parts = text.split(" ");
+  input.value = "";
+  if (!named) {
+    send("NAME", {name: text});
+    named = true;
+    input.placeholder = "Message, /w <user> <text>, /join <room>, /nick <name>";
+  } else if (parts[0] === "/w" && parts.length > 2) {
+    send("WHISPER", {to: parts[1], message: parts.slice(2).join(" ")});
+  } else if (parts[0] === "/nick" && parts.length > 1) {
+    send("NAME", {name: parts.slice(1).join(" ")});
+  } else if (parts[0] === "/join" && parts.length === 2) {
+    send("JOIN", {room: parts[1]});
+  } else {
+    send("SEND", {message: text});
+  }
+};
+</script>
+</body>
+</html>
+`
+
+// webClientPage returns the web client speaking the protocol version of
+// this package.
+func webClientPage() string {
+	return strings.Replace(webClientHTML, "PROTOCOL_VERSION", strconv.Itoa(protocol.Version), 1)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath is where ListenHTTP accepts WebSocket clients, every other
+// path serves the web client.
+const WebSocketPath = "/ws"
+
+// ListenHTTP serves the web client and the WebSocket endpoint on address,
+// accepting the same addresses as Listen.
+func (s *TcpChatServer) ListenHTTP(address string) error {
+	l, err := listen(address)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		tlsListener, err := s.listenTLS(l, address)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tlsListener
+	}
+	s.AddHTTPListener(l)
+	return nil
+}
+
+// AddHTTPListener serves HTTP requests accepted from l, it must be called
+// before Start.
+func (s *TcpChatServer) AddHTTPListener(l net.Listener) {
+	s.httpListeners = append(s.httpListeners, l)
+	s.logs <- fmt.Sprintf("%s Serving web client on %v",
+		time.Now().Format("15:04"), l.Addr())
+}
+
+func (s *TcpChatServer) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, websocket.Server{
+		Handshake: checkOrigin,
+		Handler:   s.serveWebSocket,
+	})
+	page := webClientPage()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	})
+	return mux
+}
+
+// checkOrigin only lets pages served by this server connect, so a page on
+// another site cannot reach a chat server behind the visitor's firewall.
+// Tools connecting directly send no Origin and are let in.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	if r.Header.Get("Origin") == "" {
+		return nil
+	}
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != r.Host {
+		return fmt.Errorf("origin %v does not match host %v", origin, r.Host)
+	}
+	return nil
+}
+
+// serveWebSocket runs a WebSocket client like any other connection, every
+// frame carries one command in whatever encoding the client picked.
+func (s *TcpChatServer) serveWebSocket(ws *websocket.Conn) {
+	ws.MaxPayloadBytes = s.maxFrameSize
+	conn := &wsConn{
+		Conn:   ws,
+		remote: gatewayAddr{"ws", ws.Request().RemoteAddr},
+	}
+	s.serve(s.accept(conn))
+}
+
+// wsConn turns frames back into the stream CommandReader expects: text
+// frames get the line terminator the text and JSON codecs look for, and
+// replies go out in frames of the type the client used.
+type wsConn struct {
+	*websocket.Conn
+	remote  gatewayAddr
+	pending []byte
+	// read is set once a frame was handed out, the client's writer may be
+	// running from then on.
+	read bool
+}
+
+type wsFrame struct {
+	data   []byte
+	binary bool
+}
+
+var frameCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		frame := v.(*wsFrame)
+		frame.data = data
+		frame.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var frame wsFrame
+		if err := frameCodec.Receive(c.Conn, &frame); err != nil {
+			return 0, err
+		}
+		if frame.binary {
+			// Only the first frame picks the type, the writer reads it
+			// without a lock.
+			if !c.read {
+				c.PayloadType = websocket.BinaryFrame
+			}
+		} else if n := len(frame.data); n == 0 || frame.data[n-1] != '\n' {
+			frame.data = append(frame.data, '\n')
+		}
+		c.pending = frame.data
+		c.read = true
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
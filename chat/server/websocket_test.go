@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestWebSocketOrigin lets in pages of the chat server and turns away pages
+// of other sites.
+func TestWebSocketOrigin(t *testing.T) {
+	s := startServer(t, nil)
+	web := httptest.NewServer(s.httpHandler())
+	defer web.Close()
+	url := "ws" + web.URL[len("http"):] + WebSocketPath
+
+	for _, test := range []struct {
+		origin string
+		ok     bool
+	}{
+		{web.URL, true},
+		{"http://evil.example", false},
+	} {
+		config, err := websocket.NewConfig(url, test.origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, err := websocket.DialConfig(config)
+		if (err == nil) != test.ok {
+			t.Errorf("origin %q: dial returned %v", test.origin, err)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
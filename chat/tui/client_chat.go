@@ -7,15 +7,15 @@ import (
 	"time"
 
 	"github.com/LeadNess/net-tools/chat/client"
+	"github.com/LeadNess/net-tools/chat/protocol"
 	"github.com/marcusolsson/tui-go"
 )
 
 func ChatWindowUI(c *client.TcpChatClient) tui.UI {
 	sidebar := tui.NewVBox()
-	users := strings.Join(<-c.ChatUsers(), "\n")
-	sidebar.Append(tui.NewLabel(users + "\n    "))
+	sidebar.Append(tui.NewLabel(roster(<-c.ChatUsers())))
 
-	sidebar.SetTitle("Users")
+	sidebar.SetTitle("#" + protocol.LobbyRoom)
 	sidebar.SetBorder(true)
 
 	history := tui.NewVBox()
@@ -38,7 +38,7 @@ func ChatWindowUI(c *client.TcpChatClient) tui.UI {
 	chat.SetSizePolicy(tui.Expanding, tui.Expanding)
 
 	input.OnSubmit(func(e *tui.Entry) {
-		if err := c.SendMessage(e.Text()); err != nil {
+		if err := submit(c, e.Text()); err != nil {
 			history.Append(tui.NewHBox(
 				tui.NewLabel(time.Now().Format("15:04")),
 				tui.NewPadder(1, 0, tui.NewLabel(fmt.Sprintf("Send message error: %v", err))),
@@ -56,15 +56,150 @@ func ChatWindowUI(c *client.TcpChatClient) tui.UI {
 		log.Fatal(err)
 	}
 
+	theme := tui.NewTheme()
+	theme.SetStyle("label.whisper", tui.Style{Fg: tui.ColorMagenta})
+	theme.SetStyle("label.error", tui.Style{Fg: tui.ColorRed})
+	theme.SetStyle("label.file", tui.Style{Fg: tui.ColorCyan})
+	theme.SetStyle("label.id", tui.Style{Fg: tui.ColorBlue})
+	// grey of the 256 color palette, there is no dim attribute
+	theme.SetStyle("label.history", tui.Style{Fg: tui.Color(244)})
+	ui.SetTheme(theme)
+
 	ui.SetKeybinding("Esc", func() { ui.Quit() })
 
+	// message labels by id, only touched from ui.Update
+	messages := make(map[uint64]*tui.Label)
+
+	appendMessage := func(message protocol.MessageCommand, style string) {
+		id := tui.NewLabel(fmt.Sprintf("#%d", message.ID))
+		id.SetStyleName("id")
+		text := tui.NewLabel(message.Message)
+		text.SetStyleName(style)
+		name := tui.NewLabel(fmt.Sprintf("<%s>", message.Name))
+		name.SetStyleName(style)
+		messages[message.ID] = text
+		history.Append(tui.NewHBox(
+			tui.NewLabel(message.Time.Local().Format("15:04")),
+			tui.NewPadder(1, 0, id),
+			tui.NewPadder(1, 0, name),
+			text,
+			tui.NewSpacer(),
+		))
+	}
+
+	// one goroutine for both keeps the backlog above the messages that
+	// follow it
+	go func() {
+		for {
+			select {
+			case message := <-c.Incoming():
+				ui.Update(func() {
+					appendMessage(message, "")
+				})
+			case backlog := <-c.History():
+				if len(backlog.Messages) == 0 {
+					break
+				}
+				ui.Update(func() {
+					for _, message := range backlog.Messages {
+						appendMessage(message, "history")
+					}
+					separator := tui.NewLabel("--- new messages ---")
+					separator.SetStyleName("history")
+					history.Append(tui.NewHBox(
+						tui.NewSpacer(),
+						separator,
+						tui.NewSpacer(),
+					))
+				})
+			}
+		}
+	}()
+
+	go func() {
+		for edit := range c.Edits() {
+			edit := edit
+			ui.Update(func() {
+				if text, ok := messages[edit.ID]; ok {
+					text.SetText(edit.Message + " (edited)")
+				}
+			})
+		}
+	}()
+
+	go func() {
+		for del := range c.Deletes() {
+			del := del
+			ui.Update(func() {
+				if text, ok := messages[del.ID]; ok {
+					text.SetText("(deleted)")
+					text.SetStyleName("id")
+					delete(messages, del.ID)
+				}
+			})
+		}
+	}()
+
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			latency := c.Latency()
+			ui.Update(func() {
+				historyBox.SetTitle(fmt.Sprintf("Ping %v", latency.Round(time.Millisecond)))
+			})
+		}
+	}()
+
+	go func() {
+		for ack := range c.Acks() {
+			ack := ack
+			ui.Update(func() {
+				inputBox.SetTitle(fmt.Sprintf("Sent #%d at %s",
+					ack.ID, ack.Time.Local().Format("15:04:05")))
+			})
+		}
+	}()
+
+	go func() {
+		for message := range c.Whispers() {
+			message := message
+			ui.Update(func() {
+				text := tui.NewLabel(message.Message)
+				text.SetStyleName("whisper")
+				from := tui.NewLabel(fmt.Sprintf("*%s -> %s*", message.From, message.To))
+				from.SetStyleName("whisper")
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, from),
+					text,
+					tui.NewSpacer(),
+				))
+			})
+		}
+	}()
+
+	go func() {
+		for serverErr := range c.Errors() {
+			serverErr := serverErr
+			ui.Update(func() {
+				text := tui.NewLabel(fmt.Sprintf("Error [%s]: %s", serverErr.Code, serverErr.Message))
+				text.SetStyleName("error")
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, text),
+					tui.NewSpacer(),
+				))
+			})
+		}
+	}()
+
 	go func() {
-		for message := range c.Incoming() {
+		for room := range c.Joined() {
+			room := room
 			ui.Update(func() {
+				sidebar.SetTitle("#" + room)
 				history.Append(tui.NewHBox(
 					tui.NewLabel(time.Now().Format("15:04")),
-					tui.NewPadder(1, 0, tui.NewLabel(fmt.Sprintf("<%s>", message.Name))),
-					tui.NewLabel(message.Message),
+					tui.NewPadder(1, 0, tui.NewLabel(fmt.Sprintf("You joined #%s", room))),
 					tui.NewSpacer(),
 				))
 			})
@@ -72,14 +207,112 @@ func ChatWindowUI(c *client.TcpChatClient) tui.UI {
 	}()
 
 	go func() {
-		for usersSlice := range c.ChatUsers() {
+		for results := range c.Results() {
+			results := results
+			ui.Update(func() {
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, tui.NewLabel(fmt.Sprintf("Found %d messages", len(results.Messages)))),
+					tui.NewSpacer(),
+				))
+				for _, message := range results.Messages {
+					id := tui.NewLabel(fmt.Sprintf("#%d", message.ID))
+					id.SetStyleName("id")
+					text := tui.NewLabel(fmt.Sprintf("#%s <%s> %s", message.Room, message.Name, message.Message))
+					text.SetStyleName("history")
+					history.Append(tui.NewHBox(
+						tui.NewLabel(message.Time.Local().Format("2006-01-02 15:04")),
+						tui.NewPadder(1, 0, id),
+						text,
+						tui.NewSpacer(),
+					))
+				}
+			})
+		}
+	}()
+
+	go func() {
+		for rename := range c.Renames() {
+			text := fmt.Sprintf("%s is now known as %s", rename.From, rename.To)
+			if rename.From == "" {
+				text = "You are now known as " + rename.To
+			}
+			ui.Update(func() {
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, tui.NewLabel(text)),
+					tui.NewSpacer(),
+				))
+			})
+		}
+	}()
+
+	go func() {
+		for rooms := range c.Rooms() {
+			var buf strings.Builder
+			for _, room := range rooms {
+				buf.WriteString(fmt.Sprintf(" #%s (%d)", room.Name, room.Users))
+			}
+			ui.Update(func() {
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, tui.NewLabel("Rooms:"+buf.String())),
+					tui.NewSpacer(),
+				))
+			})
+		}
+	}()
+
+	go func() {
+		for offer := range c.FileOffers() {
+			offer := offer
+			ui.Update(func() {
+				text := tui.NewLabel(fmt.Sprintf("%s offers %s (%d bytes), type /accept %s to download",
+					offer.From, offer.Name, offer.Size, offer.ID))
+				text.SetStyleName("file")
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, text),
+					tui.NewSpacer(),
+				))
+			})
+		}
+	}()
+
+	go func() {
+		for download := range c.Downloads() {
+			text := fmt.Sprintf("Saved %s from %s to %s", download.Name, download.From, download.Path)
+			if download.Err != nil {
+				text = fmt.Sprintf("Download of %s from %s failed: %v", download.Name, download.From, download.Err)
+			}
+			ui.Update(func() {
+				label := tui.NewLabel(text)
+				label.SetStyleName("file")
+				history.Append(tui.NewHBox(
+					tui.NewLabel(time.Now().Format("15:04")),
+					tui.NewPadder(1, 0, label),
+					tui.NewSpacer(),
+				))
+			})
+		}
+	}()
+
+	go func() {
+		for users := range c.ChatUsers() {
+			users := users
 			ui.Update(func() {
 				sidebar.Remove(0)
-				users := strings.Join(usersSlice, "\n")
-				sidebar.Append(tui.NewLabel(users + "\n    "))
+				sidebar.Append(tui.NewLabel(roster(users)))
 			})
 		}
 	}()
 
 	return ui
-}
\ No newline at end of file
+}
+func roster(users []protocol.UserInfo) string {
+	lines := make([]string, len(users))
+	for i, user := range users {
+		lines[i] = user.String()
+	}
+	return strings.Join(lines, "\n") + "\n    "
+}
@@ -24,16 +24,21 @@ func LoginWindowUI() *client.TcpChatClient {
 	username := tui.NewEntry()
 	username.SetFocused(true)
 
+	password := tui.NewEntry()
+	password.SetEchoMode(tui.EchoModePassword)
+
 	address := tui.NewEntry()
 
 	form := tui.NewGrid(0, 0)
-	form.AppendRow(tui.NewLabel("User"), tui.NewLabel("Server address"))
-	form.AppendRow(username, address)
+	form.AppendRow(tui.NewLabel("User"), tui.NewLabel("Password (optional)"), tui.NewLabel("Server address"))
+	form.AppendRow(username, password, address)
 
 	connect := tui.NewButton("[Connect]")
+	register := tui.NewButton("[Register]")
 
 	button := tui.NewHBox(
 		tui.NewSpacer(),
+		tui.NewPadder(1, 0, register),
 		tui.NewPadder(1, 0, connect),
 	)
 
@@ -56,7 +61,7 @@ func LoginWindowUI() *client.TcpChatClient {
 
 	root := tui.NewVBox(content)
 
-	tui.DefaultFocusChain.Set(username, address, connect)
+	tui.DefaultFocusChain.Set(username, password, address, connect, register)
 
 	ui, err := tui.New(root)
 	if err != nil {
@@ -67,20 +72,37 @@ func LoginWindowUI() *client.TcpChatClient {
 		ui.Quit()
 		os.Exit(0)
 	})
-	chatClient := client.NewClient()
-	connect.OnActivated(func(b *tui.Button) {
+	var chatClient *client.TcpChatClient
+	login := func(newAccount bool) {
+		chatClient = client.NewClient()
 		if err := chatClient.Dial(address.Text()); err != nil {
 			info.SetText(fmt.Sprintf("Connect error: %v", err))
 			return
 		}
 
-		go chatClient.Start()
-
-		if err := chatClient.SetName(username.Text()); err != nil {
-			info.SetText(fmt.Sprintf("Set name error: %v", err))
+		var err error
+		switch {
+		case newAccount:
+			err = chatClient.Register(username.Text(), password.Text())
+		case password.Text() != "":
+			err = chatClient.Login(username.Text(), password.Text())
+		default:
+			err = chatClient.Nick(username.Text())
+		}
+		if err != nil {
+			chatClient.Close()
+			info.SetText(fmt.Sprintf("Login error: %v", err))
 			return
 		}
+
+		go chatClient.Start()
 		ui.Quit()
+	}
+	connect.OnActivated(func(b *tui.Button) {
+		login(false)
+	})
+	register.OnActivated(func(b *tui.Button) {
+		login(true)
 	})
 
 	if err := ui.Run(); err != nil {
@@ -0,0 +1,205 @@
+package tui
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeadNess/net-tools/chat/client"
+	"github.com/LeadNess/net-tools/chat/protocol"
+)
+
+type chatCommand struct {
+	usage string
+	args  int
+	// optional allows to omit the last argument
+	optional bool
+	run      func(c *client.TcpChatClient, args []string) error
+}
+
+var chatCommands = map[string]chatCommand{
+	"/w": {
+		usage: "/w <user> <message>",
+		args:  2,
+		run: func(c *client.TcpChatClient, args []string) error {
+			return c.Whisper(args[0], args[1])
+		},
+	},
+	"/nick": {
+		usage: "/nick <name>",
+		args:  1,
+		run: func(c *client.TcpChatClient, args []string) error {
+			return c.SetName(args[0])
+		},
+	},
+	"/join": {
+		usage: "/join <room>",
+		args:  1,
+		run: func(c *client.TcpChatClient, args []string) error {
+			return c.Join(args[0])
+		},
+	},
+	"/part": {
+		usage: "/part",
+		run: func(c *client.TcpChatClient, args []string) error {
+			return c.Part("")
+		},
+	},
+	"/send": {
+		usage: "/send <user|#room> <path>",
+		args:  2,
+		run: func(c *client.TcpChatClient, args []string) error {
+			_, err := c.SendFile(args[0], args[1])
+			return err
+		},
+	},
+	"/accept": {
+		usage: "/accept <file id>",
+		args:  1,
+		run: func(c *client.TcpChatClient, args []string) error {
+			return c.AcceptFile(args[0])
+		},
+	},
+	"/edit": {
+		usage: "/edit <message id> <text>",
+		args:  2,
+		run: func(c *client.TcpChatClient, args []string) error {
+			id, err := parseMessageID(args[0])
+			if err != nil {
+				return err
+			}
+			return c.Edit(id, args[1])
+		},
+	},
+	"/delete": {
+		usage: "/delete <message id>",
+		args:  1,
+		run: func(c *client.TcpChatClient, args []string) error {
+			id, err := parseMessageID(args[0])
+			if err != nil {
+				return err
+			}
+			return c.Delete(id)
+		},
+	},
+	"/status": {
+		usage:    "/status <online|away|busy> [text]",
+		args:     2,
+		optional: true,
+		run: func(c *client.TcpChatClient, args []string) error {
+			if len(args) == 1 {
+				args = append(args, "")
+			}
+			return c.SetStatus(args[0], args[1])
+		},
+	},
+	"/search": {
+		usage:    "/search [from:<user>] [in:<room>] [since:<date>] [until:<date>] [text]",
+		args:     1,
+		optional: true,
+		run: func(c *client.TcpChatClient, args []string) error {
+			query, err := parseSearch(strings.Join(args, ""))
+			if err != nil {
+				return err
+			}
+			return c.Search(query)
+		},
+	},
+	"/list": {
+		usage: "/list",
+		run: func(c *client.TcpChatClient, args []string) error {
+			return c.ListRooms()
+		},
+	},
+}
+
+// submit sends the input line as a chat message unless it starts with one of
+// the slash commands, the last argument of a command takes the rest of the line
+// and the others may be quoted: /w "John Smith" hi.
+func submit(c *client.TcpChatClient, text string) error {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return c.SendMessage(strings.TrimPrefix(text, "/"))
+	}
+	parts := strings.SplitN(text, " ", 2)
+	command, ok := chatCommands[parts[0]]
+	if !ok {
+		return errors.New("unknown command " + parts[0])
+	}
+	var args []string
+	if len(parts) > 1 && command.args > 0 {
+		rest := strings.TrimSpace(parts[1])
+		for len(args) < command.args-1 && rest != "" {
+			arg, tail, err := protocol.NextField(rest)
+			if err != nil {
+				return err
+			}
+			args = append(args, arg)
+			rest = strings.TrimLeft(tail, " ")
+		}
+		if rest != "" {
+			args = append(args, rest)
+		}
+	}
+	required := command.args
+	if command.optional {
+		required--
+	}
+	if len(args) < required {
+		return errors.New("usage: " + command.usage)
+	}
+	return command.run(c, args)
+}
+
+// searchTimeLayouts are accepted by since: and until:, in local time.
+var searchTimeLayouts = []string{"2006-01-02", "2006-01-02T15:04"}
+
+// parseSearch turns the filters of /search into a query, the other words are
+// the text to look for. Filters with spaces are quoted as a whole:
+// "from:John Smith".
+func parseSearch(str string) (protocol.SearchCommand, error) {
+	var query protocol.SearchCommand
+	var words []string
+	for rest := strings.TrimSpace(str); rest != ""; {
+		word, tail, err := protocol.NextField(rest)
+		if err != nil {
+			return query, err
+		}
+		rest = strings.TrimLeft(tail, " ")
+		switch {
+		case strings.HasPrefix(word, "from:"):
+			query.Name = strings.TrimPrefix(word, "from:")
+		case strings.HasPrefix(word, "in:"):
+			query.Room = strings.TrimPrefix(strings.TrimPrefix(word, "in:"), "#")
+		case strings.HasPrefix(word, "since:"):
+			if query.Since, err = parseSearchTime(strings.TrimPrefix(word, "since:")); err != nil {
+				return query, err
+			}
+		case strings.HasPrefix(word, "until:"):
+			if query.Until, err = parseSearchTime(strings.TrimPrefix(word, "until:")); err != nil {
+				return query, err
+			}
+		default:
+			words = append(words, word)
+		}
+	}
+	query.Text = strings.Join(words, " ")
+	return query, nil
+}
+
+func parseSearchTime(str string) (time.Time, error) {
+	for _, layout := range searchTimeLayouts {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("bad time " + str + ", use YYYY-MM-DD or YYYY-MM-DDTHH:MM")
+}
+
+func parseMessageID(str string) (uint64, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(str, "#"), 10, 64)
+	if err != nil {
+		return 0, errors.New("bad message id " + str)
+	}
+	return id, nil
+}
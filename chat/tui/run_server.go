@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/LeadNess/net-tools/chat/server"
 	"github.com/marcusolsson/tui-go"
@@ -24,9 +25,21 @@ func RunServerUI() *server.TcpChatServer {
 	address := tui.NewEntry()
 	address.SetFocused(true)
 
+	webAddress := tui.NewEntry()
+	ircAddress := tui.NewEntry()
+	certFile := tui.NewEntry()
+	keyFile := tui.NewEntry()
+	operators := tui.NewEntry()
+
 	form := tui.NewGrid(0, 0)
-	form.AppendRow(tui.NewLabel("Server address"))
+	form.AppendRow(tui.NewLabel("Server addresses (comma separated)"))
 	form.AppendRow(address)
+	form.AppendRow(tui.NewLabel("Web client address (optional)"), tui.NewLabel("IRC address (optional)"))
+	form.AppendRow(webAddress, ircAddress)
+	form.AppendRow(tui.NewLabel("TLS certificate (optional)"), tui.NewLabel("TLS key"))
+	form.AppendRow(certFile, keyFile)
+	form.AppendRow(tui.NewLabel("Operator accounts (comma separated, optional)"))
+	form.AppendRow(operators)
 
 	runServer := tui.NewButton("[Run server]")
 
@@ -54,7 +67,7 @@ func RunServerUI() *server.TcpChatServer {
 
 	root := tui.NewVBox(content)
 
-	tui.DefaultFocusChain.Set(address, runServer)
+	tui.DefaultFocusChain.Set(address, webAddress, ircAddress, certFile, keyFile, operators, runServer)
 
 	ui, err := tui.New(root)
 	if err != nil {
@@ -66,12 +79,41 @@ func RunServerUI() *server.TcpChatServer {
 		os.Exit(0)
 	})
 
-	chatServer := server.NewServer()
+	var chatServer *server.TcpChatServer
 
 	runServer.OnActivated(func(b *tui.Button) {
-		if err = chatServer.Listen(address.Text()); err != nil {
-			info.SetText(fmt.Sprintf("Running server error: %v", err))
-			return
+		chatServer = server.NewServer()
+		if certFile.Text() != "" {
+			// A missing certificate is generated, clients pin it on first use.
+			chatServer.SetTLS(certFile.Text(), keyFile.Text(), true)
+		}
+		var accounts []string
+		for _, account := range strings.Split(operators.Text(), ",") {
+			if account = strings.TrimSpace(account); account != "" {
+				accounts = append(accounts, account)
+			}
+		}
+		chatServer.SetOperators(accounts...)
+		for _, addr := range strings.Split(address.Text(), ",") {
+			if err = chatServer.Listen(strings.TrimSpace(addr)); err != nil {
+				chatServer.Close()
+				info.SetText(fmt.Sprintf("Running server error: %v", err))
+				return
+			}
+		}
+		if webAddress.Text() != "" {
+			if err = chatServer.ListenHTTP(webAddress.Text()); err != nil {
+				chatServer.Close()
+				info.SetText(fmt.Sprintf("Running web client error: %v", err))
+				return
+			}
+		}
+		if ircAddress.Text() != "" {
+			if err = chatServer.ListenIRC(ircAddress.Text()); err != nil {
+				chatServer.Close()
+				info.SetText(fmt.Sprintf("Running IRC gateway error: %v", err))
+				return
+			}
 		}
 		ui.Quit()
 	})
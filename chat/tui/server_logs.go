@@ -3,14 +3,15 @@ package tui
 import (
 	"fmt"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/LeadNess/net-tools/chat/server"
 	"github.com/marcusolsson/tui-go"
 )
 
-func ServerLogsUI(chatServer *server.TcpChatServer) tui.UI {
+// ServerLogsUI shows the server's logs and clients, Esc calls shutdown and
+// the UI keeps showing logs until the caller quits it.
+func ServerLogsUI(chatServer *server.TcpChatServer, shutdown func()) tui.UI {
 	sidebar := tui.NewVBox()
 	users := strings.Join(chatServer.ClientsUsernames(), "\n")
 	sidebar.Append(tui.NewLabel(users + "\n       "))
@@ -37,10 +38,7 @@ func ServerLogsUI(chatServer *server.TcpChatServer) tui.UI {
 		log.Fatal(err)
 	}
 
-	ui.SetKeybinding("Esc", func() {
-		ui.Quit()
-		os.Exit(0)
-	})
+	ui.SetKeybinding("Esc", shutdown)
 
 	go func() {
 		for logString := range chatServer.Logs() {
@@ -59,8 +57,8 @@ func ServerLogsUI(chatServer *server.TcpChatServer) tui.UI {
 				sidebar.Remove(0)
 				var buf strings.Builder
 				for _, client := range clients {
-					buf.WriteString(fmt.Sprintf("%s [%s]\n",
-						client.Name, client.Conn.RemoteAddr().String()))
+					buf.WriteString(fmt.Sprintf("%s [%s] #%s %s\n",
+						client.Name, client.Addr, client.Room, client.Status))
 				}
 				sidebar.Append(tui.NewLabel(buf.String()))
 			})